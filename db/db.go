@@ -27,6 +27,10 @@ func ConnectDatabase(ctx types.Context) {
 	// user specific routes
 	database.AutoMigrate(&types.User{})
 
+	// The SigningKey model is special due to the 'secret' field, and has
+	// signing key specific routes
+	database.AutoMigrate(&types.SigningKey{})
+
 	// Generic CRUD data types
 	ConfigureTypes(database, types.Log{}, types.KeyValuePair{})
 	ConfigureTypes(database, types.User{}, types.Settings{})
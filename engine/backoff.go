@@ -0,0 +1,44 @@
+package engine
+
+import (
+	"strconv"
+	"time"
+)
+
+// backoff computes capped exponentially growing delays between reconnect attempts
+type backoff struct {
+	min   time.Duration
+	max   time.Duration
+	delay time.Duration
+}
+
+func newBackoff() *backoff {
+	min, _ := strconv.Atoi(InitSetting("reconnect.mindelay", "1000", "Milliseconds to wait before the first attempt to reconnect a group's data source").Value)
+	max, _ := strconv.Atoi(InitSetting("reconnect.maxdelay", "60000", "Max milliseconds between attempts to reconnect a group's data source").Value)
+	if min < 1 {
+		min = 1000
+	}
+	if max < min {
+		max = min
+	}
+
+	return &backoff{min: time.Duration(min) * time.Millisecond, max: time.Duration(max) * time.Millisecond}
+}
+
+// next returns the delay before the next attempt, twice the previous one up to max
+func (b *backoff) next() time.Duration {
+	b.delay *= 2
+	if b.delay < b.min {
+		b.delay = b.min
+	}
+	if b.delay > b.max {
+		b.delay = b.max
+	}
+
+	return b.delay
+}
+
+// reset starts over from the min delay after a successful attempt
+func (b *backoff) reset() {
+	b.delay = 0
+}
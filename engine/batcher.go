@@ -0,0 +1,239 @@
+package engine
+
+import (
+	"dd-opcda/logger"
+	"dd-opcda/types"
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+// batcher collects the data points of a group into messages. A message is sent when
+// the next point would make it larger than the smallest max datagram size of the route
+// in any of the route's wire formats, when it holds the max batch size, when its oldest
+// point has waited the max latency, and at the end of every collection cycle, so no
+// point waits for the next cycle
+type batcher struct {
+	group    *types.OPCGroup
+	route    []*types.DiodeProxy
+	formats  []int // Wire formats of the proxies in the route
+	msg      *types.DataMessage
+	size     int
+	sizes    []int       // Max datagram size of each proxy in the route
+	points   map[int]int // Encoded size of the pending points in each wire format
+	base     time.Time   // First and last point times, binary point times are deltas
+	previous time.Time
+	latency  time.Duration
+	timer    *time.Timer
+}
+
+func newBatcher(group *types.OPCGroup, route []*types.DiodeProxy) *batcher {
+	size, _ := strconv.Atoi(InitSetting("batch.maxsize", "0", "Max number of data points in a data message, 0 = as many as fit the max datagram size of the proxies").Value)
+	if size < 0 {
+		size = 0
+	}
+
+	latency, _ := strconv.Atoi(InitSetting("batch.maxlatency", "1000", "Max milliseconds a data point may wait for its message to be sent, 0 = end of cycle only").Value)
+
+	b := &batcher{group: group, route: route, size: size, points: map[int]int{}, latency: time.Duration(latency) * time.Millisecond}
+	for _, proxy := range route {
+		b.sizes = append(b.sizes, maxDatagramSize(proxy))
+		if _, ok := b.points[proxy.Format]; !ok {
+			b.points[proxy.Format] = 0
+			b.formats = append(b.formats, proxy.Format)
+		}
+	}
+
+	b.msg = &types.DataMessage{Version: 2, Group: group.Name, Interval: group.Interval / 1000, IntervalMs: group.Interval}
+	return b
+}
+
+// add appends a point to the pending message, sending the message first if the point
+// does not fit, and sends it when full
+func (b *batcher) add(point types.DataPoint) {
+	if len(b.msg.Points) > 0 && !b.fits(point) {
+		b.flush()
+	}
+
+	if len(b.msg.Points) == 0 {
+		b.msg.Points = make([]types.DataPoint, 0, b.size)
+		if b.latency > 0 {
+			b.timer = time.NewTimer(b.latency)
+		}
+		if !b.fits(point) {
+			logger.Trace("Batcher", "Data point %s of group %s does not fit a datagram of %d bytes and will be fragmented", point.Name, b.group.Name, b.limit())
+		}
+	}
+
+	for _, format := range b.formats {
+		b.points[format] += b.pointSize(format, point)
+	}
+	if !point.Time.IsZero() {
+		if b.base.IsZero() {
+			b.base = point.Time
+		}
+		b.previous = point.Time
+	}
+
+	b.msg.Points = append(b.msg.Points, point)
+	if b.size > 0 && len(b.msg.Points) >= b.size {
+		b.flush()
+	}
+}
+
+// limit returns the smallest max data message size of the proxies in the route, or 0
+// if the route is empty. It is checked for every point, as it shrinks when a proxy
+// gets its first signing key
+func (b *batcher) limit() (limit int) {
+	for i, proxy := range b.route {
+		if size := payloadSize(proxy, b.sizes[i]); limit == 0 || size < limit {
+			limit = size
+		}
+	}
+
+	return limit
+}
+
+// fits returns true if the pending message with the point added is within the max
+// datagram size in every wire format of the route
+func (b *batcher) fits(point types.DataPoint) bool {
+	count := len(b.msg.Points) + 1
+	limit := b.limit()
+	for _, format := range b.formats {
+		if b.headerSize(format, count, point)+b.points[format]+b.pointSize(format, point) > limit {
+			return false
+		}
+	}
+
+	return true
+}
+
+// oversize returns true if the pending message is larger than the max datagram size in
+// any wire format of the route
+func (b *batcher) oversize() bool {
+	count := len(b.msg.Points)
+	limit := b.limit()
+	for _, format := range b.formats {
+		if b.headerSize(format, count, b.msg.Points[count-1])+b.points[format] > limit {
+			return true
+		}
+	}
+
+	return false
+}
+
+// headerSize returns the encoded size of the pending message without its points, when
+// it holds count points and the point is the last
+func (b *batcher) headerSize(format int, count int, point types.DataPoint) int {
+	if format == types.FormatBinary {
+		base := b.base
+		if base.IsZero() {
+			base = point.Time
+		}
+		return b.msg.BinaryHeaderSize(count, base)
+	}
+
+	header := *b.msg
+	header.Count = count
+	header.Points = []types.DataPoint{}
+	data, _ := json.Marshal(&header)
+	return len(data)
+}
+
+// pointSize returns the encoded size of the point added to the pending message
+func (b *batcher) pointSize(format int, point types.DataPoint) int {
+	if format == types.FormatBinary {
+		previous := b.previous
+		if previous.IsZero() {
+			previous = point.Time
+		}
+		return types.BinaryPointSize(point, previous)
+	}
+
+	data, _ := json.Marshal(&point)
+	return len(data) + 1 // Separating comma
+}
+
+// expired fires when the oldest pending point has waited the max latency. It blocks
+// forever while nothing is pending
+func (b *batcher) expired() <-chan time.Time {
+	if b.timer == nil {
+		return nil
+	}
+
+	return b.timer.C
+}
+
+// encode returns the pending message in a wire format. Messages that cannot be encoded
+// in binary are sent as JSON
+func (b *batcher) encode(format int) []byte {
+	if format == types.FormatBinary {
+		data, err := b.msg.MarshalBinary()
+		if err == nil {
+			return data
+		}
+		logger.Error("Batcher", "Failed to encode binary message for group %s, sending JSON, error: %s", b.group.Name, err.Error())
+	}
+
+	data, _ := json.Marshal(b.msg)
+	return data
+}
+
+// flush sends the pending points, if any
+func (b *batcher) flush() {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+
+	if len(b.msg.Points) == 0 {
+		return
+	}
+
+	// A signing key added since the message was started can make it too large, its
+	// points are then batched again into messages that fit
+	if len(b.msg.Points) > 1 && b.oversize() {
+		points := b.msg.Points
+		b.reset()
+		for _, point := range points {
+			b.add(point)
+		}
+		if len(b.msg.Points) == 0 {
+			return
+		}
+		if b.timer != nil {
+			b.timer.Stop()
+			b.timer = nil
+		}
+	}
+
+	b.msg.Count = len(b.msg.Points)
+	if len(b.route) > 0 {
+		// Each proxy gets the message in its own wire format, encoded once per format
+		encoded := map[int][]byte{types.FormatJSON: b.encode(types.FormatJSON)}
+		for _, proxy := range b.route {
+			data, ok := encoded[proxy.Format]
+			if !ok {
+				data = b.encode(proxy.Format)
+				encoded[proxy.Format] = data
+			}
+			send([]*types.DiodeProxy{proxy}, channelData, data)
+		}
+		logger.NotifySubscribers("data.message", string(encoded[types.FormatJSON]))
+		cacheMessage(b.msg, b.route[0])
+		b.msg.Sequence++
+	}
+
+	b.reset()
+}
+
+// reset drops the pending points. The cache keeps the sent points, so a new slice is
+// started
+func (b *batcher) reset() {
+	b.msg.Points = nil
+	for format := range b.points {
+		b.points[format] = 0
+	}
+	b.base = time.Time{}
+	b.previous = time.Time{}
+}
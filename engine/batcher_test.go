@@ -0,0 +1,212 @@
+package engine
+
+import (
+	"dd-opcda/sign"
+	"dd-opcda/types"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testProxy returns a proxy queueing the data messages it is sent
+func testProxy(format int, size int) *types.DiodeProxy {
+	return &types.DiodeProxy{Name: "test", Format: format, MaxDatagramSize: size, DataChan: make(chan []byte, 100)}
+}
+
+// testPoint returns the i:th point of a cycle, with a float64 value as collected
+func testPoint(i int) types.DataPoint {
+	point := types.DataPoint{ID: i + 1, Time: time.Date(2026, 10, 18, 12, 0, 0, i*1000, time.UTC), Quality: types.QualityGood}
+	point.Value, point.Type = types.EncodeValue(float64(i) * 1.5)
+	return point
+}
+
+// sent returns the messages queued for the proxy, decoded from its wire format
+func sent(t *testing.T, proxy *types.DiodeProxy) (messages []*types.DataMessage) {
+	t.Helper()
+	for {
+		select {
+		case data := <-proxy.DataChan:
+			if limit := payloadSize(proxy, proxy.MaxDatagramSize); len(data) > limit {
+				t.Errorf("message of %d bytes sent to a proxy taking %d", len(data), limit)
+			}
+
+			msg := &types.DataMessage{}
+			var err error
+			if proxy.Format == types.FormatBinary {
+				err = msg.UnmarshalBinary(data)
+			} else {
+				err = json.Unmarshal(data, msg)
+			}
+			if err != nil {
+				t.Fatalf("sent message does not decode: %s", err)
+			}
+			if msg.Count != len(msg.Points) {
+				t.Errorf("message count %d for %d points", msg.Count, len(msg.Points))
+			}
+			messages = append(messages, msg)
+		default:
+			return messages
+		}
+	}
+}
+
+// checkPoints fails the test unless the messages hold the first count points in order,
+// numbered in sequence
+func checkPoints(t *testing.T, messages []*types.DataMessage, count int) {
+	t.Helper()
+	next := 0
+	for i, msg := range messages {
+		if msg.Sequence != messages[0].Sequence+uint64(i) {
+			t.Errorf("message %d has sequence %d, want %d", i, msg.Sequence, messages[0].Sequence+uint64(i))
+		}
+		for _, point := range msg.Points {
+			if point.ID != next+1 {
+				t.Fatalf("point %d sent as point %d", point.ID, next+1)
+			}
+			next++
+		}
+	}
+
+	if next != count {
+		t.Errorf("%d points sent, want %d", next, count)
+	}
+}
+
+func TestBatchEndOfCycle(t *testing.T) {
+	proxy := testProxy(types.FormatJSON, 1472)
+	b := newBatcher(&types.OPCGroup{Name: t.Name(), Interval: 1000}, []*types.DiodeProxy{proxy})
+	for i := 0; i < 3; i++ {
+		b.add(testPoint(i))
+	}
+
+	if messages := sent(t, proxy); len(messages) != 0 {
+		t.Fatalf("%d messages sent before the end of the cycle", len(messages))
+	}
+	if b.expired() == nil {
+		t.Errorf("no max latency timer for pending points")
+	}
+
+	b.flush()
+	messages := sent(t, proxy)
+	if len(messages) != 1 {
+		t.Fatalf("%d messages sent at the end of the cycle, want 1", len(messages))
+	}
+	checkPoints(t, messages, 3)
+	if messages[0].Interval != 1 || messages[0].IntervalMs != 1000 {
+		t.Errorf("interval %d s %d ms, want 1 s 1000 ms", messages[0].Interval, messages[0].IntervalMs)
+	}
+
+	// Nothing is sent for a cycle without points
+	b.flush()
+	if messages := sent(t, proxy); len(messages) != 0 || b.expired() != nil {
+		t.Errorf("empty flush sent %d messages", len(messages))
+	}
+}
+
+func TestBatchMaxSize(t *testing.T) {
+	PutSetting("batch.maxsize", "3")
+	defer PutSetting("batch.maxsize", "0")
+
+	proxy := testProxy(types.FormatJSON, 1472)
+	b := newBatcher(&types.OPCGroup{Name: t.Name(), Interval: 1000}, []*types.DiodeProxy{proxy})
+	for i := 0; i < 7; i++ {
+		b.add(testPoint(i))
+	}
+
+	if messages := sent(t, proxy); len(messages) != 2 {
+		t.Fatalf("%d full messages sent, want 2", len(messages))
+	}
+
+	b.flush()
+	messages := sent(t, proxy)
+	if len(messages) != 1 || len(messages[0].Points) != 1 {
+		t.Fatalf("end of cycle sent %d messages, want 1 of the last point", len(messages))
+	}
+}
+
+func TestBatchDatagramLimit(t *testing.T) {
+	tests := []struct {
+		name  string
+		route []*types.DiodeProxy
+	}{
+		{"json", []*types.DiodeProxy{testProxy(types.FormatJSON, 300)}},
+		{"binary", []*types.DiodeProxy{testProxy(types.FormatBinary, 100)}},
+		{"mixed", []*types.DiodeProxy{testProxy(types.FormatBinary, 1472), testProxy(types.FormatJSON, 400)}},
+		{"fec", []*types.DiodeProxy{{Format: types.FormatJSON, MaxDatagramSize: 300, FECGroupSize: 4, DataChan: make(chan []byte, 100)}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := newBatcher(&types.OPCGroup{Name: t.Name(), Interval: 1000}, test.route)
+			for i := 0; i < 40; i++ {
+				b.add(testPoint(i))
+			}
+			b.flush()
+
+			// Every proxy gets the same messages, each within the smallest datagram
+			var first []*types.DataMessage
+			for _, proxy := range test.route {
+				messages := sent(t, proxy)
+				if len(messages) < 2 {
+					t.Fatalf("%d messages for 40 points, want them split", len(messages))
+				}
+				checkPoints(t, messages, 40)
+				if first != nil && len(messages) != len(first) {
+					t.Errorf("%d messages to one proxy and %d to another", len(messages), len(first))
+				}
+				first = messages
+			}
+		})
+	}
+}
+
+func TestBatchOversizePoint(t *testing.T) {
+	proxy := testProxy(types.FormatJSON, 100)
+	b := newBatcher(&types.OPCGroup{Name: t.Name(), Interval: 1000}, []*types.DiodeProxy{proxy})
+	point := testPoint(0)
+	point.Name = strings.Repeat("x", 200)
+	b.add(point)
+	b.flush()
+
+	// A point larger than a datagram is sent alone, to be fragmented
+	select {
+	case data := <-proxy.DataChan:
+		msg := &types.DataMessage{}
+		if err := json.Unmarshal(data, msg); err != nil || len(msg.Points) != 1 {
+			t.Errorf("oversize point not sent alone, err: %v", err)
+		}
+	default:
+		t.Errorf("oversize point not sent")
+	}
+}
+
+func TestBatchRebatch(t *testing.T) {
+	key, err := sign.ParseKey(1, strings.Repeat("a", 64), time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := testProxy(types.FormatBinary, 200)
+	b := newBatcher(&types.OPCGroup{Name: t.Name(), Interval: 1000}, []*types.DiodeProxy{proxy})
+	count := 0
+	for ; b.fits(testPoint(count)); count++ {
+		b.add(testPoint(count))
+	}
+	if messages := sent(t, proxy); len(messages) != 0 {
+		t.Fatalf("%d messages sent before the pending message was full", len(messages))
+	}
+
+	// The first signing key shrinks the datagram by the signature, so the full pending
+	// message is split when it is sent
+	proxy.Keyring = sign.NewKeyring(key)
+	b.flush()
+	messages := sent(t, proxy)
+	if len(messages) != 2 {
+		t.Fatalf("%d messages after the limit shrank, want 2", len(messages))
+	}
+	checkPoints(t, messages, count)
+	if b.expired() != nil {
+		t.Errorf("max latency timer left running after the flush")
+	}
+}
@@ -8,7 +8,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
@@ -18,17 +17,28 @@ import (
 	"time"
 )
 
-var channel chan types.DataMessage
-var file *os.File
-var gzw *gzip.Writer
-var fw *bufio.Writer
-var firstWrite bool
-var prevRemainder int
+type cacheRequest struct {
+	proxy uint
+	msg   types.DataMessage
+}
+
+// cacheWriter writes the messages sent through one proxy to its own cache files
+type cacheWriter struct {
+	file          *os.File
+	gzw           *gzip.Writer
+	fw            *bufio.Writer
+	firstWrite    bool
+	prevRemainder int
+}
+
+var channel chan cacheRequest
+var writers map[uint]*cacheWriter
 
 type CacheItem struct {
 	Filename string    `json:"filename"`
 	Time     time.Time `json:"time"`
 	Size     int64     `json:"size"`
+	ProxyID  uint      `json:"proxyid"`
 }
 
 type CacheInfo struct {
@@ -47,19 +57,24 @@ var cacheMutex sync.Mutex
 func InitCache() {
 	InitSetting("cache.retention", "7", "Number of days to retain cached files")
 
-	createFile()
-	prevRemainder = -1
-	channel = make(chan types.DataMessage)
+	writers = make(map[uint]*cacheWriter)
+	channel = make(chan cacheRequest)
 	go processMessages()
 	go pruneCache()
 }
 
 func CloseCache() {
-	if fw != nil {
-		fw.Write([]byte("]"))
-		fw.Flush()
-		gzw.Close()
-		file.Close()
+	for _, w := range writers {
+		w.close()
+	}
+}
+
+func (w *cacheWriter) close() {
+	if w.fw != nil {
+		w.fw.Write([]byte("]"))
+		w.fw.Flush()
+		w.gzw.Close()
+		w.file.Close()
 	}
 }
 
@@ -80,7 +95,7 @@ func ResendCacheItems(items []CacheItem) int {
 	}
 
 	count := 0
-	if proxy == nil {
+	if FirstProxy() == nil {
 		logger.Trace("Cache error", "No proxy defined")
 		return 0
 	}
@@ -88,7 +103,12 @@ func ResendCacheItems(items []CacheItem) int {
 	for _, item := range items {
 		for _, fi := range cacheInfo.Items {
 			if fi.Filename == item.Filename {
-				count += resendCacheItem(item, proxy)
+				// Resend through the proxy the data was originally sent through
+				target := GetProxy(fi.ProxyID)
+				if target == nil {
+					target = FirstProxy()
+				}
+				count += resendCacheItem(fi, target)
 				break
 			}
 		}
@@ -98,30 +118,13 @@ func ResendCacheItems(items []CacheItem) int {
 }
 
 func SendFullCache() error {
-	// Just copy the files to the outgoing file transfer directory
-	return copyDir("cache", "outgoing/new")
-}
-
-func copyDir(source, destination string) error {
-	var err error = filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
-		var relPath string = strings.Replace(path, source, "", 1)
-		if relPath == "" {
-			return nil
-		}
-		if info.IsDir() {
-			return os.MkdirAll(filepath.Join(destination, relPath), 0755)
-		} else {
-			var data, err1 = ioutil.ReadFile(filepath.Join(source, relPath))
-			if err1 != nil {
-				return err1
-			}
-			return ioutil.WriteFile(filepath.Join(destination, relPath), data, 0777)
-		}
-	})
-	if err != nil {
-		logger.Error("Cache", "copy command failed: %s", err.Error())
+	// Resend every cached file through the proxy it was sent through
+	info := GetCacheInfo()
+	if count := ResendCacheItems(info.Items); count < info.Count {
+		return logger.Error("Cache", "Only %d of %d cached files could be queued for transfer", count, info.Count)
 	}
-	return err
+
+	return nil
 }
 
 func copyFile(src, dst string) (err error) {
@@ -152,14 +155,37 @@ func copyFile(src, dst string) (err error) {
 }
 
 func resendCacheItem(item CacheItem, proxy *types.DiodeProxy) int {
-	// First put it on the file transfer directory
-	newFilename := path.Join("outgoing", "new", item.Filename)
+	if transfer == nil {
+		logger.Error("Cache", "File transfer is not running, cannot resend %s", item.Filename)
+		return 0
+	}
+
+	// First put it in the file transfer processing area, then queue it for the proxy. The
+	// receiver sees the same cache/yyyy/mm/dd directory regardless of proxy
+	name := path.Base(filepath.ToSlash(item.Filename))
+	dir := path.Join("cache", item.Time.Format("2006/01/02"))
+	newFilename := path.Join(transfer.basedir, transfer.processingdir, dir, name)
 	if err := copyFile(item.Filename, newFilename); err != nil {
 		logger.Error("Cache", "Failed to copy file %s to %s, error: %s", item.Filename, newFilename, err.Error())
+		return 0
 	}
+
+	queueFile(&types.FileInfo{Name: name, Path: dir, Size: int(item.Size), Date: item.Time}, proxy)
 	return 1
 }
 
+// proxyFromFilename returns the ID of the proxy a cache file belongs to. Files cached
+// before caches were kept per proxy belong to the default proxy (0)
+func proxyFromFilename(filename string) uint {
+	var id uint
+	parts := strings.Split(filepath.ToSlash(filename), "/")
+	if len(parts) > 1 {
+		fmt.Sscanf(parts[1], "proxy-%d", &id)
+	}
+
+	return id
+}
+
 func getTimeFromFilename(filename string) time.Time {
 	var year, day, hour, minute int
 	var month time.Month
@@ -170,7 +196,7 @@ func getTimeFromFilename(filename string) time.Time {
 
 func indexer(p string, info os.FileInfo, err error) error {
 	if !info.IsDir() {
-		item := &CacheItem{Filename: p, Time: getTimeFromFilename(info.Name()), Size: info.Size()}
+		item := &CacheItem{Filename: p, Time: getTimeFromFilename(info.Name()), Size: info.Size(), ProxyID: proxyFromFilename(p)}
 		cacheInfo.Items = append(cacheInfo.Items, *item)
 		cacheInfo.Size += info.Size()
 	}
@@ -188,50 +214,57 @@ func refreshCache() {
 	cacheMutex.Unlock()
 }
 
-func cacheMessage(msg *types.DataMessage) {
-	channel <- *msg
+func cacheMessage(msg *types.DataMessage, proxy *types.DiodeProxy) {
+	channel <- cacheRequest{proxy: proxy.ID, msg: *msg}
 }
 
 func processMessages() {
 	for {
-		msg := <-channel
+		req := <-channel
+		w, ok := writers[req.proxy]
+		if !ok {
+			w = &cacheWriter{prevRemainder: -1}
+			w.createFile(req.proxy)
+			writers[req.proxy] = w
+		}
+
 		remainder := time.Now().UTC().Minute() % 5 // New file every 5 minutes
-		if remainder == 0 && remainder != prevRemainder {
-			createFile()
+		if remainder == 0 && remainder != w.prevRemainder {
+			w.createFile(req.proxy)
 		}
 
-		prevRemainder = remainder
+		w.prevRemainder = remainder
 
-		if fw != nil {
-			if firstWrite {
-				fw.Write([]byte("["))
+		if w.fw != nil {
+			if w.firstWrite {
+				w.fw.Write([]byte("["))
 			} else {
-				fw.Write([]byte(","))
+				w.fw.Write([]byte(","))
 			}
 
-			data, _ := json.Marshal(msg)
-			fw.Write(data)
+			data, _ := json.Marshal(req.msg)
+			w.fw.Write(data)
 
-			firstWrite = false
+			w.firstWrite = false
 		}
 	}
 }
 
-func createFile() {
+func (w *cacheWriter) createFile(proxy uint) {
 	now := time.Now().UTC()
-	dirpath := fmt.Sprintf("cache/%d/%02d/%02d", now.Year(), now.Month(), now.Day())
+	dirpath := fmt.Sprintf("cache/proxy-%d/%d/%02d/%02d", proxy, now.Year(), now.Month(), now.Day())
 	filename := fmt.Sprintf("dd_%d_%02d_%02d-%02d_%02d.json.gz", now.Year(), now.Month(), now.Day(), now.Hour(), now.Minute())
 	fullname := path.Join(dirpath, filename)
 
 	os.MkdirAll(dirpath, os.ModePerm)
 
-	CloseCache()
+	w.close()
 
 	// If the file doesn't exist, create it, or append to the file
-	file, _ = os.OpenFile(fullname, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	gzw = gzip.NewWriter(file)
-	fw = bufio.NewWriter(gzw)
-	firstWrite = true
+	w.file, _ = os.OpenFile(fullname, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	w.gzw = gzip.NewWriter(w.file)
+	w.fw = bufio.NewWriter(w.gzw)
+	w.firstWrite = true
 }
 
 func pruneCache() {
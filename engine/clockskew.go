@@ -0,0 +1,70 @@
+package engine
+
+import (
+	"dd-opcda/types"
+	"strconv"
+	"time"
+)
+
+// skewDetector estimates how far local time is ahead of the server's clock. OPC DA item
+// timestamps are the time of the last change, so only items whose timestamp advanced
+// since the previous read are used, and the newest of those should be at most one
+// update interval old
+type skewDetector struct {
+	threshold time.Duration
+	interval  time.Duration
+	last      map[string]time.Time
+	skewed    bool
+}
+
+// SkewEvent is published as 'group.clockskew' when a group's server clock drifts
+// beyond, or returns within, the max clock skew
+type SkewEvent struct {
+	GroupID uint    `json:"groupid"`
+	Group   string  `json:"group"`
+	Skew    float64 `json:"skew"` // Seconds local time is ahead of server time
+	Skewed  bool    `json:"skewed"`
+}
+
+func newSkewDetector(group *types.OPCGroup) *skewDetector {
+	seconds := group.MaxClockSkew
+	if seconds <= 0 {
+		seconds, _ = strconv.Atoi(InitSetting("clock.maxskew", "10", "Max number of seconds server time may drift from local time").Value)
+		if seconds <= 0 {
+			seconds = 10
+		}
+	}
+
+	interval := time.Duration(group.Interval) * time.Millisecond
+	if group.Mode == types.GroupModeSubscription && group.UpdateRate > 0 {
+		interval = time.Duration(group.UpdateRate) * time.Millisecond
+	}
+
+	return &skewDetector{threshold: time.Duration(seconds) * time.Second, interval: interval, last: map[string]time.Time{}}
+}
+
+// measure returns the skew seen in items received at now, and false if no item changed
+func (d *skewDetector) measure(items map[string]DataItem, now time.Time) (skew time.Duration, ok bool) {
+	var newest time.Time
+	for name, item := range items {
+		if item.Timestamp.IsZero() {
+			continue
+		}
+
+		if last, seen := d.last[name]; seen && item.Timestamp.After(last) && item.Timestamp.After(newest) {
+			newest = item.Timestamp
+		}
+		d.last[name] = item.Timestamp
+	}
+
+	if newest.IsZero() {
+		return 0, false
+	}
+
+	return now.Sub(newest), true
+}
+
+// exceeded returns true if the skew is beyond the threshold, allowing lag of one interval
+func (d *skewDetector) exceeded(skew time.Duration) bool {
+	return skew < -d.threshold || skew > d.threshold+d.interval
+}
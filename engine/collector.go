@@ -0,0 +1,498 @@
+package engine
+
+import (
+	"dd-opcda/db"
+	"dd-opcda/logger"
+	"dd-opcda/types"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// collector samples the tags of one group and hands the points to its batcher. It
+// is run by the group supervisor, which owns the group's lifecycle state
+type collector struct {
+	group      *types.OPCGroup
+	tags       []*types.OPCTag // Tags read from the data source
+	tagmap     map[string]*types.OPCTag
+	states     map[string]*tagState
+	calculated []*calculation
+	latest     map[string]DataItem
+	silence    time.Duration
+	batch      *batcher
+	timer      *cycleTimer
+	retry      *backoff
+	skew       *skewDetector
+	stop       <-chan struct{}
+	cycle      uint64 // Number of the current cycle, counting skipped cycles
+	sets       []*rateSet
+	runner     *groupRunner
+	badcycles  int // Cycles with every item disconnected before reconnecting, 0 = never
+	badcount   int // Consecutive cycles with every item disconnected
+}
+
+// rateSet is the item set of the tags of a group read every multiple cycles
+type rateSet struct {
+	multiple int
+	names    []string
+}
+
+// calculation is a calculated tag of the group being collected
+type calculation struct {
+	tag   *types.OPCTag
+	expr  *expression
+	error string // Last evaluation error, logged once
+}
+
+// groupDataCollector collects the tags of the runner's group until stop is closed. A
+// lost connection to the data source is re-established with capped exponential backoff
+func groupDataCollector(stop <-chan struct{}, runner *groupRunner, tags []*types.OPCTag) {
+	defer handlePanic("groupDataCollector")
+
+	c := newCollector(stop, runner, tags)
+	defer c.batch.flush()
+	defer c.timer.Stop()
+
+	group := c.group
+	group.Counter = 0
+	group.MissedCycles = 0
+	group.Reconnects = 0
+	group.LastError = ""
+	group.JitterMean = 0
+	group.JitterMax = 0
+	db.DB.Model(group).Updates(map[string]interface{}{"counter": 0, "missed_cycles": 0, "reconnects": 0, "last_error": "", "jitter_mean": 0, "jitter_max": 0})
+
+	for {
+		err := c.attempt()
+		if err == nil || !c.current() {
+			return
+		}
+
+		group.LastError = err.Error()
+		logger.Log("error", "Lost connection to data source", fmt.Sprintf("Group: %s, progid: %s, err: %s", group.Name, group.ProgID, err.Error()))
+		if group.State != types.GroupStateDegraded {
+			setGroupState(group, types.GroupStateDegraded)
+		}
+		logger.NotifySubscribers("group.failed", group)
+
+		delay := c.retry.next()
+		db.DB.Model(group).Update("last_error", group.LastError)
+
+		select {
+		case <-stop:
+			logger.Log("info", "OPC group stopped", fmt.Sprintf("Group stopped while reconnecting, group: %s", group.Name))
+			if c.current() {
+				logger.NotifySubscribers("group.stopped", group)
+			}
+			return
+		case <-time.After(delay):
+		}
+
+		if !c.current() {
+			return
+		}
+
+		group.Reconnects++
+		db.DB.Model(group).Update("reconnects", group.Reconnects)
+		logger.Log("info", "Reconnecting data source", fmt.Sprintf("Group: %s, progid: %s, attempt: %d", group.Name, group.ProgID, group.Reconnects))
+	}
+}
+
+// newCollector prepares the collector of the tags of the runner's group
+func newCollector(stop <-chan struct{}, runner *groupRunner, tags []*types.OPCTag) *collector {
+	group := runner.collected
+	route := groupRoute(group)
+	if len(route) == 0 {
+		logger.Log("warning", "No proxy for group", fmt.Sprintf("Group: %s, collected data will not be sent", group.Name))
+	}
+
+	badcycles, _ := strconv.Atoi(InitSetting("reconnect.badcycles", "3", "Consecutive cycles with every item of a group not connected or failing communication before the group reconnects, 0 = never").Value)
+
+	c := &collector{group: group, runner: runner, stop: stop, silence: maxSilence(group), retry: newBackoff(), skew: newSkewDetector(group), badcycles: badcycles}
+	c.tagmap = make(map[string]*types.OPCTag, len(tags))
+	c.states = make(map[string]*tagState, len(tags))
+	c.latest = make(map[string]DataItem, len(tags))
+	for _, tag := range tags {
+		c.tagmap[tag.Name] = tag
+		if tag.Expression == "" {
+			c.tags = append(c.tags, tag)
+			continue
+		}
+
+		expr, err := parseExpression(tag.Expression)
+		if err != nil {
+			logger.Log("warning", "Unable to calculate tag", fmt.Sprintf("%s, group: %s, err: %s", tag.Name, group.Name, err.Error()))
+			continue
+		}
+		c.calculated = append(c.calculated, &calculation{tag: tag, expr: expr})
+	}
+
+	c.batch = newBatcher(group, route)
+	c.timer = newCycleTimer(time.Duration(group.Interval)*time.Millisecond, group.AlignToClock)
+	return c
+}
+
+// current returns false once the supervisor has abandoned the collector, which must
+// then leave the group's state, status and events to a collector started again
+func (c *collector) current() bool {
+	return runnerCurrent(c.runner)
+}
+
+// attempt connects the data source and collects until stopped, which returns nil, or
+// until the connection is lost. Panics from the data source count as a lost connection
+func (c *collector) attempt() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("data source panic, recovery: %#v", r)
+		}
+	}()
+
+	source, err := c.connect()
+	if source != nil {
+		defer source.Close()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return c.session(source)
+}
+
+// connect opens one data source for the group, adds the tags to it and groups the
+// added tags by rate multiple, so the tags read every Nth cycle are a separate item set
+func (c *collector) connect() (DataSource, error) {
+	group := c.group
+	source, err := NewDataSource(groupSourceType(group))
+	if err != nil {
+		return nil, err
+	}
+	if err := source.Connect(group.ProgID); err != nil {
+		return source, err
+	}
+
+	c.sets = nil
+	multiples := map[int]*rateSet{}
+	for _, tag := range c.tags {
+		if err := source.Add(tag.Name); err != nil {
+			logger.Log("warning", "Unable to collect tag", fmt.Sprintf("%s, group: %s, progid: %s", tag.Name, group.Name, group.ProgID))
+			continue
+		}
+		if reader, ok := source.(PropertyReader); ok {
+			readProperties(reader, tag)
+		}
+
+		multiple := tag.RateMultiple
+		if multiple < 1 {
+			multiple = 1
+		}
+
+		set, ok := multiples[multiple]
+		if !ok {
+			set = &rateSet{multiple: multiple}
+			multiples[multiple] = set
+			c.sets = append(c.sets, set)
+		}
+		set.names = append(set.names, tag.Name)
+	}
+
+	if count := len(source.Tags()); count > 0 {
+		logger.Log("trace", "Collecting tags", fmt.Sprintf("%d tags from group: %s", count, group.Name))
+		return source, nil
+	}
+
+	return source, fmt.Errorf("no tags to collect")
+}
+
+// readProperties stores the item properties of a tag, which are sent with its meta data
+func readProperties(reader PropertyReader, tag *types.OPCTag) {
+	props, err := reader.Properties(tag.Name)
+	if err != nil {
+		logger.Trace("Item properties", "Unable to read properties of %s, err: %s", tag.Name, err.Error())
+		return
+	}
+
+	if props.DataType == tag.DataType && props.AccessRights == tag.AccessRights && props.Description == tag.ItemDescription &&
+		props.Unit == tag.ItemUnit && sameFloat(props.EULow, tag.ItemEULow) && sameFloat(props.EUHigh, tag.ItemEUHigh) {
+		return
+	}
+
+	tag.DataType = props.DataType
+	tag.AccessRights = props.AccessRights
+	tag.ItemDescription = props.Description
+	tag.ItemUnit = props.Unit
+	tag.ItemEULow = props.EULow
+	tag.ItemEUHigh = props.EUHigh
+	db.DB.Model(tag).Updates(map[string]interface{}{"data_type": tag.DataType, "access_rights": tag.AccessRights, "item_description": tag.ItemDescription,
+		"item_unit": tag.ItemUnit, "item_eu_low": tag.ItemEULow, "item_eu_high": tag.ItemEUHigh})
+}
+
+// sameFloat returns true if both are nil or both have the same value
+func sameFloat(a *float64, b *float64) bool {
+	return (a == nil && b == nil) || (a != nil && b != nil && *a == *b)
+}
+
+// session collects from the connected data source, see attempt
+func (c *collector) session(source DataSource) error {
+	group := c.group
+	if !c.current() {
+		return nil
+	}
+
+	// Items of a previous connection do not count towards a lost connection
+	c.latest = make(map[string]DataItem, len(c.tags))
+	c.badcount = 0
+
+	// Initiate group running state, degraded if not all tags could be added
+	healthy := len(source.Tags()) == len(c.tags)
+	if healthy {
+		setGroupState(group, types.GroupStateRunning)
+		logger.NotifySubscribers("group.started", group)
+	} else {
+		setGroupState(group, types.GroupStateDegraded)
+		logger.NotifySubscribers("group.warning", group)
+	}
+
+	// In subscription mode, changed items of all tags are pushed by the data source and
+	// the timer is only used to check the connection and update the group status
+	var subscriber Subscriber
+	changes := make(chan map[string]DataItem)
+	done := make(chan struct{})
+	if group.Mode == types.GroupModeSubscription {
+		var err error
+		subscriber, err = subscribe(source, group, func(items map[string]DataItem) {
+			select {
+			case changes <- items:
+			case <-done:
+			}
+		})
+
+		if err != nil {
+			return fmt.Errorf("failed to subscribe: %s", err.Error())
+		}
+
+		defer subscriber.Unsubscribe()
+	}
+
+	// Pushes waiting for the collector are released before unsubscribing
+	defer close(done)
+
+	// Aligned groups wait for the first wall-clock boundary before reading
+	for ready := !group.AlignToClock; ; ready = true {
+		if subscriber != nil {
+			if err := subscriber.Check(); err != nil {
+				return err
+			}
+		} else if ready {
+			// Read the item sets due this cycle in one read and collect them as one. A
+			// failed read of the connection is a lost connection
+			var names []string
+			for _, set := range c.sets {
+				if c.cycle%uint64(set.multiple) == 0 {
+					names = append(names, set.names...)
+				}
+			}
+
+			if len(names) > 0 {
+				items, err := source.Read(names)
+				if err != nil {
+					return err
+				}
+				c.collect(items)
+			}
+		}
+
+		// A collector abandoned while reading leaves the group to a restarted one
+		if !c.current() {
+			return nil
+		}
+
+		// Every point sampled in this cycle leaves before the next one
+		c.sweep(time.Now())
+		c.batch.flush()
+		if err := c.checkConnection(); err != nil {
+			return err
+		}
+		if c.badcount == 0 {
+			c.retry.reset()
+		}
+
+		db.DB.Model(group).Updates(types.OPCGroup{LastRun: group.LastRun, Counter: group.Counter, MissedCycles: group.MissedCycles, ClockSkew: group.ClockSkew, JitterMean: group.JitterMean, JitterMax: group.JitterMax})
+		logger.NotifySubscribers("data.group", group)
+
+	wait:
+		for {
+			select {
+			case <-c.stop:
+				logger.Log("info", "OPC group stopped", fmt.Sprintf("Group interval timer STOPPED, group: %s", group.Name))
+				if c.current() {
+					logger.NotifySubscribers("group.stopped", group)
+				}
+				return nil
+			case <-c.timer.C:
+				skipped := c.timer.advance()
+				group.MissedCycles += skipped
+				group.JitterMean = c.timer.jitter.mean()
+				group.JitterMax = c.timer.jitter.maximum()
+				c.cycle += 1 + uint64(skipped)
+				break wait
+			case items := <-changes:
+				if c.current() {
+					c.collect(items)
+				}
+			case <-c.batch.expired():
+				c.batch.flush()
+			}
+		}
+	}
+}
+
+// collect runs items through scaling and deadbands into the batch, followed by the
+// calculated tags evaluated over the latest values of the group
+func (c *collector) collect(items map[string]DataItem) {
+	now := time.Now()
+	c.checkClock(items, now)
+
+	for k, v := range items {
+		v = scale(c.tagmap[k], v)
+		c.latest[k] = v
+		c.emit(k, v, now)
+	}
+
+	for _, calc := range c.calculated {
+		v, err := calc.expr.evaluate(c.latest, now)
+		if err != nil && err.Error() != calc.error {
+			logger.Trace("Calculated tag", "%s, group: %s, err: %s", calc.tag.Name, c.group.Name, err.Error())
+		}
+		calc.error = ""
+		if err != nil {
+			calc.error = err.Error()
+		}
+		c.emit(calc.tag.Name, scale(calc.tag, v), now)
+	}
+
+	c.group.LastRun = now
+	c.group.Counter = c.group.Counter + uint(len(items))
+}
+
+func (c *collector) emit(name string, v DataItem, now time.Time) {
+	state, ok := c.states[name]
+	if !ok {
+		state = &tagState{}
+		c.states[name] = state
+	}
+
+	// A tag that becomes, or is no longer, frozen or stale is sent regardless of deadbands
+	tag := c.tagmap[name]
+	state.observe(v, now)
+	frozen, stale := staleThresholds(tag, c.group)
+	flags, changed := state.checkStale(now, frozen, stale)
+	if changed {
+		notifyStale(tag, name, c.group, state)
+	}
+
+	c.send(name, state, v, now, flags, changed)
+}
+
+// sweep checks the frozen and stale thresholds of all tags and sends the last
+// collected value of the tags whose flags changed
+func (c *collector) sweep(now time.Time) {
+	for name, state := range c.states {
+		tag := c.tagmap[name]
+		frozen, stale := staleThresholds(tag, c.group)
+		flags, changed := state.checkStale(now, frozen, stale)
+		if !changed {
+			continue
+		}
+
+		notifyStale(tag, name, c.group, state)
+		c.send(name, state, *state.observed, now, flags, true)
+	}
+}
+
+// checkConnection counts the cycles in which the latest values of all items have bad
+// quality with substatus not connected or communication failure, which is how OPC DA
+// servers report a lost connection to the underlying devices, and returns an error
+// when there have been 'reconnect.badcycles' of them in a row
+func (c *collector) checkConnection() error {
+	if c.badcycles <= 0 || !disconnected(c.latest) {
+		c.badcount = 0
+		return nil
+	}
+
+	c.badcount++
+	if c.badcount < c.badcycles {
+		return nil
+	}
+
+	return fmt.Errorf("all %d items not connected or failing communication for %d cycles", len(c.latest), c.badcount)
+}
+
+// disconnected returns true if there are items and all have bad quality with substatus
+// not connected or communication failure
+func disconnected(items map[string]DataItem) bool {
+	for _, item := range items {
+		if substatus := item.Quality & types.QualitySubstatusMask; substatus != types.QualityNotConnected && substatus != types.QualityCommFailure {
+			return false
+		}
+	}
+
+	return len(items) > 0
+}
+
+// send adds a point of the item to the batch if the quality policy and the deadbands
+// pass it, or if forced
+func (c *collector) send(name string, state *tagState, v DataItem, now time.Time, flags int, force bool) {
+	tag := c.tagmap[name]
+	v, ok := state.applyQualityPolicy(c.group.QualityPolicy, v)
+	if !ok {
+		return
+	}
+
+	if !state.report(tag, v, now, c.silence) {
+		if !force {
+			return
+		}
+		state.update(tag, v, now)
+	}
+
+	point := types.DataPoint{Time: v.Timestamp, Name: name, Quality: int(v.Quality), Flags: flags}
+	point.Value, point.Type = types.EncodeValue(v.Value)
+	if tag != nil {
+		point.ID = int(tag.ID)
+	}
+	switch c.group.TimestampSource {
+	case types.TimestampLocal:
+		point.Time = now
+	case types.TimestampBoth:
+		point.Received = &now
+	}
+	if c.group.QualityText {
+		point.QualityText = types.DecodeQuality(v.Quality).String()
+	}
+	c.batch.add(point)
+}
+
+// checkClock measures the skew between local and server time and logs and notifies
+// when it goes beyond or returns within the group's max clock skew
+func (c *collector) checkClock(items map[string]DataItem, now time.Time) {
+	skew, ok := c.skew.measure(items, now)
+	if !ok {
+		return
+	}
+
+	c.group.ClockSkew = skew.Seconds()
+	skewed := c.skew.exceeded(skew)
+	if skewed == c.skew.skewed {
+		return
+	}
+
+	c.skew.skewed = skewed
+	if skewed {
+		logger.Log("warning", "Server clock skew", fmt.Sprintf("Group: %s, progid: %s, local time is %s ahead of server time", c.group.Name, c.group.ProgID, skew.String()))
+	} else {
+		logger.Log("info", "Server clock skew resolved", fmt.Sprintf("Group: %s, progid: %s, local time is %s ahead of server time", c.group.Name, c.group.ProgID, skew.String()))
+	}
+
+	logger.NotifySubscribers("group.clockskew", SkewEvent{GroupID: c.group.ID, Group: c.group.Name, Skew: skew.Seconds(), Skewed: skewed})
+}
@@ -0,0 +1,163 @@
+package engine
+
+import (
+	"dd-opcda/db"
+	"dd-opcda/types"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMain runs the tests with a database in a temporary working directory, as the
+// engine keeps its settings, groups and message cache there
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "dd-opcda-engine")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = os.Chdir(dir); err != nil {
+		log.Fatal(err)
+	}
+
+	db.ConnectDatabase(types.Context{Wdir: dir})
+	InitCache()
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// testCollector returns a collector of simulator items, with its runner registered as
+// the current one of the group
+func testCollector(t *testing.T, names ...string) *collector {
+	group := &types.OPCGroup{Name: t.Name(), ProgID: simulatorProgID, SourceType: DataSourceSimulator, Interval: 20}
+	db.DB.Create(group)
+
+	var tags []*types.OPCTag
+	for _, name := range names {
+		tag := &types.OPCTag{Name: name, GroupID: group.ID}
+		db.DB.Create(tag)
+		tags = append(tags, tag)
+	}
+
+	runner := &groupRunner{group: group, collected: group, done: make(chan struct{}), state: types.GroupStateStarting}
+	runnersMutex.Lock()
+	runners[group.ID] = runner
+	runnersMutex.Unlock()
+
+	c := newCollector(nil, runner, tags)
+	t.Cleanup(func() {
+		c.timer.Stop()
+		runnersMutex.Lock()
+		delete(runners, group.ID)
+		runnersMutex.Unlock()
+	})
+
+	return c
+}
+
+// runSession collects from the simulator until the session ends or the timeout, when
+// the collector is stopped
+func runSession(t *testing.T, c *collector, timeout time.Duration) error {
+	source, err := c.connect()
+	if source != nil {
+		defer source.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	c.stop = stop
+	result := make(chan error, 1)
+	go func() { result <- c.session(source) }()
+
+	select {
+	case err = <-result:
+		return err
+	case <-time.After(timeout):
+	}
+
+	close(stop)
+	select {
+	case err = <-result:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("collector did not stop")
+	}
+
+	return nil
+}
+
+func TestDisconnectedItemsReconnect(t *testing.T) {
+	PutSetting("reconnect.badcycles", "3")
+	PutSetting("simulator.disconnected", "1")
+	defer PutSetting("simulator.disconnected", "0")
+
+	c := testCollector(t, "numeric.sine", "numeric.ramp")
+	err := runSession(t, c, 5*time.Second)
+	if err == nil || !strings.Contains(err.Error(), "not connected") {
+		t.Fatalf("session with all items not connected ended with err %v, want a lost connection", err)
+	}
+	if c.badcount != 3 {
+		t.Errorf("lost connection after %d bad cycles, want 3", c.badcount)
+	}
+}
+
+func TestBadItemsDoNotReconnect(t *testing.T) {
+	tests := []struct {
+		name      string
+		badcycles string
+		settings  map[string]string
+	}{
+		// Bad quality that is not a lost connection, e.g. a configuration error
+		{"bad non-specific", "3", map[string]string{"simulator.badquality": "100"}},
+		{"detection disabled", "0", map[string]string{"simulator.disconnected": "1"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			PutSetting("reconnect.badcycles", test.badcycles)
+			for key, value := range test.settings {
+				PutSetting(key, value)
+			}
+			defer PutSetting("simulator.badquality", "0")
+			defer PutSetting("simulator.disconnected", "0")
+
+			c := testCollector(t, "numeric.sine", "numeric.ramp")
+			if err := runSession(t, c, 300*time.Millisecond); err != nil {
+				t.Fatalf("session ended with err %s, want it to run until stopped", err)
+			}
+			if c.group.Counter == 0 {
+				t.Errorf("no items collected")
+			}
+		})
+	}
+
+	PutSetting("reconnect.badcycles", "3")
+}
+
+func TestDisconnected(t *testing.T) {
+	notConnected := DataItem{Quality: types.QualityNotConnected}
+	commFailure := DataItem{Quality: types.QualityCommFailure | 0x01} // Low limited
+	tests := []struct {
+		name  string
+		items map[string]DataItem
+		want  bool
+	}{
+		{"none", map[string]DataItem{}, false},
+		{"all not connected", map[string]DataItem{"a": notConnected, "b": notConnected}, true},
+		{"mixed lost connection", map[string]DataItem{"a": notConnected, "b": commFailure}, true},
+		{"one good", map[string]DataItem{"a": notConnected, "b": {Quality: types.QualityGood}}, false},
+		{"bad non-specific", map[string]DataItem{"a": {Quality: types.QualityBad}}, false},
+		{"uncertain", map[string]DataItem{"a": {Quality: types.QualityUncertain | 0x08}}, false},
+	}
+
+	for _, test := range tests {
+		if got := disconnected(test.items); got != test.want {
+			t.Errorf("%s: %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package engine
+
+import (
+	"dd-opcda/types"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Names of the built-in data source types
+const (
+	DataSourceOPCDA     = "opcda"
+	DataSourceSimulator = "simulator"
+)
+
+// DataItem is a single value read from a data source
+type DataItem struct {
+	Value     interface{}
+	Quality   int
+	Timestamp time.Time
+}
+
+// Bad returns true if the OPC quality of the item is bad
+func (i DataItem) Bad() bool {
+	return types.QualityBadStatus(i.Quality)
+}
+
+// ItemProperties are the properties a data source reports for an item
+type ItemProperties struct {
+	DataType     int // Canonical data type as a VARIANT type, e.g. 5 = VT_R8
+	AccessRights int // 1 = readable, 2 = writable, 3 = both
+	Description  string
+	Unit         string
+	EULow        *float64 // Nil if the source does not provide the range
+	EUHigh       *float64
+}
+
+// PropertyReader is implemented by data sources that can read item properties
+type PropertyReader interface {
+	Properties(name string) (ItemProperties, error)
+}
+
+// Browser walks the item tree of a data source server
+type Browser interface {
+	MoveHome()
+	MoveTo(branch string)
+	Position() string
+	Branches() []string
+	Leaves() []string
+}
+
+// DataSource is the connection a group collects its tags through. Each backend
+// (OPC DA, simulator, ...) registers itself with RegisterDataSource
+type DataSource interface {
+	Connect(progid string) error
+	Add(name string) error
+	Tags() []string
+	Read(names []string) (map[string]DataItem, error) // The named items, or all if names is nil
+	Browse(progid string) (Browser, error)
+	Close()
+}
+
+type dataSourceType struct {
+	create   func() DataSource
+	discover func() []string
+}
+
+var dataSourceTypes = make(map[string]*dataSourceType)
+var traceDataSources bool
+
+// RegisterDataSource makes a backend available to groups and servers. The discover
+// function returns the program IDs of the servers the backend can reach
+func RegisterDataSource(name string, create func() DataSource, discover func() []string) {
+	dataSourceTypes[name] = &dataSourceType{create: create, discover: discover}
+}
+
+// NewDataSource creates an unconnected data source of the named type
+func NewDataSource(name string) (DataSource, error) {
+	t, ok := dataSourceTypes[name]
+	if !ok {
+		return nil, fmt.Errorf("no such data source type: %s", name)
+	}
+
+	return t.create(), nil
+}
+
+// DataSourceTypes returns the registered backend names in a stable order
+func DataSourceTypes() []string {
+	names := make([]string, 0, len(dataSourceTypes))
+	for name := range dataSourceTypes {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// TraceDataSources enables backend specific tracing, if the backend supports it
+func TraceDataSources() {
+	traceDataSources = true
+}
@@ -0,0 +1,619 @@
+// +build windows
+
+package engine
+
+import (
+	"dd-opcda/logger"
+	"dd-opcda/types"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/cyops-se/opc"
+	"github.com/go-ole/go-ole"
+	"github.com/go-ole/go-ole/oleutil"
+)
+
+// OPC DA item property IDs
+const (
+	opcPropertyDataType     = 1
+	opcPropertyAccessRights = 5
+	opcPropertyUnit         = 100
+	opcPropertyDescription  = 101
+	opcPropertyEUHigh       = 102
+	opcPropertyEULow        = 103
+)
+
+var opcPropertyIDs = []int32{opcPropertyDataType, opcPropertyAccessRights, opcPropertyUnit, opcPropertyDescription, opcPropertyEUHigh, opcPropertyEULow}
+
+// The automation interface takes and returns 1-based arrays, which go-ole can not
+// create or convert, so they are handled through oleaut32 directly
+var (
+	oleaut32                  = syscall.NewLazyDLL("oleaut32.dll")
+	procSafeArrayCreateVector = oleaut32.NewProc("SafeArrayCreateVector")
+	procSafeArrayPutElement   = oleaut32.NewProc("SafeArrayPutElement")
+	procSafeArrayGetElement   = oleaut32.NewProc("SafeArrayGetElement")
+	procSafeArrayGetLBound    = oleaut32.NewProc("SafeArrayGetLBound")
+	procSafeArrayGetUBound    = oleaut32.NewProc("SafeArrayGetUBound")
+)
+
+// OPC automation constants
+const (
+	opcSourceCache   = 1 // Read items from the server's cache, kept current by the active group
+	opcServerRunning = 1 // ServerState of a server that is running normally
+)
+
+var opcmutex sync.Mutex // Issue #3, no time to find out where thread insafety is (looks like it's in or below oleutil)
+var opcdebug sync.Once
+
+// opcDataSource reads items through its own connection to the automation wrapper, so
+// item values are read as VARIANTs and arrays, currency and decimal values are kept.
+// The opc package is used for server discovery and browsing
+type opcDataSource struct {
+	progid string
+	server *ole.IDispatch // OPCServer automation object
+	groups *ole.IDispatch // OPCGroups of the server
+	group  *ole.IDispatch // The OPCGroup holding the items of the data source
+	items  *ole.IDispatch // OPCItems of the group
+	tags   map[string]*ole.IDispatch
+	names  []string              // Added item names in the order they were added
+	point  *ole.IConnectionPoint // DataChange events of the group while subscribed
+	cookie uint32
+	sink   *opcEventSink
+}
+
+type opcBrowser struct {
+	cursor *ole.VARIANT
+}
+
+func init() {
+	RegisterDataSource(DataSourceOPCDA, func() DataSource { return &opcDataSource{} }, discoverOPCServers)
+}
+
+func discoverOPCServers() (progids []string) {
+	defer handlePanic("discoverOPCServers")
+
+	// Test if we can connect Graybox.Simulator since we can't browse it
+	if client, err := opc.NewConnection(
+		"Graybox.Simulator.1",                              // ProgId
+		[]string{"localhost"},                              //  OPC servers nodes
+		[]string{"numeric.sin.int64", "numeric.saw.float"}, // slice of OPC tags
+	); err == nil {
+		progids = append(progids, "Graybox.Simulator")
+		defer client.Close()
+	}
+
+	if ao := opc.NewAutomationObject(); ao != nil {
+		serversfound := ao.GetOPCServers("localhost")
+		logger.Log("trace", "OPC server init", fmt.Sprintf("Found %d server(s) on '%s':\n", len(serversfound)+len(progids), "localhost"))
+		for _, server := range serversfound {
+			logger.Log("trace", "OPC server found", server)
+			progids = append(progids, server)
+		}
+	} else {
+		logger.Log("error", "OPC server init failure", "Unable to get new automation object")
+	}
+
+	return
+}
+
+// Connect connects the automation wrapper to the server and adds an active group for
+// the items of the data source
+func (s *opcDataSource) Connect(progid string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("OPC connect failed, recovery: %#v", r)
+		}
+	}()
+
+	if traceDataSources {
+		opcdebug.Do(opc.Debug)
+	}
+
+	opcmutex.Lock()
+	defer opcmutex.Unlock()
+
+	s.progid = progid
+	s.tags = make(map[string]*ole.IDispatch)
+	if s.server, err = opcAutomationServer(progid); err != nil {
+		return err
+	}
+
+	groups, err := oleutil.GetProperty(s.server, "OPCGroups")
+	if err != nil {
+		return err
+	}
+	s.groups = groups.ToIDispatch()
+
+	group, err := oleutil.CallMethod(s.groups, "Add")
+	if err != nil {
+		return err
+	}
+	s.group = group.ToIDispatch()
+
+	if _, err = oleutil.PutProperty(s.group, "IsActive", true); err != nil {
+		return err
+	}
+
+	items, err := oleutil.GetProperty(s.group, "OPCItems")
+	if err != nil {
+		return err
+	}
+	s.items = items.ToIDispatch()
+
+	return nil
+}
+
+func (s *opcDataSource) Add(name string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("OPC add item failed, recovery: %#v", r)
+		}
+	}()
+
+	opcmutex.Lock()
+	defer opcmutex.Unlock()
+
+	if _, ok := s.tags[name]; ok {
+		return nil
+	}
+
+	item, err := oleutil.CallMethod(s.items, "AddItem", name, int32(len(s.names)+1))
+	if err != nil {
+		return err
+	}
+
+	s.tags[name] = item.ToIDispatch()
+	s.names = append(s.names, name)
+	return nil
+}
+
+func (s *opcDataSource) Tags() []string {
+	return append([]string(nil), s.names...)
+}
+
+// Read reads the items from the server's cache. A server that is no longer running,
+// or a failed call to the server, is a lost connection
+func (s *opcDataSource) Read(names []string) (items map[string]DataItem, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("OPC read failed, recovery: %#v", r)
+		}
+	}()
+
+	opcmutex.Lock()
+	defer opcmutex.Unlock()
+
+	if err = s.running(); err != nil {
+		return nil, err
+	}
+
+	if names == nil {
+		names = s.names
+	}
+
+	items = make(map[string]DataItem, len(names))
+	for _, name := range names {
+		item, ok := s.tags[name]
+		if !ok {
+			continue
+		}
+
+		if items[name], err = opcReadItem(item); err != nil {
+			return nil, fmt.Errorf("OPC read of %s failed: %s", name, err.Error())
+		}
+	}
+
+	return items, nil
+}
+
+// running returns an error if the server is not connected or no longer running
+func (s *opcDataSource) running() error {
+	if s.server == nil {
+		return fmt.Errorf("OPC server %s not connected", s.progid)
+	}
+
+	state, err := oleutil.GetProperty(s.server, "ServerState")
+	if err != nil {
+		return err
+	}
+	if running, _ := toFloat(state.Value()); running != opcServerRunning {
+		return fmt.Errorf("OPC server %s is not running, state: %v", s.progid, state.Value())
+	}
+
+	return nil
+}
+
+// opcReadItem reads the value, quality and timestamp of an item as VARIANTs
+func opcReadItem(item *ole.IDispatch) (DataItem, error) {
+	var value, quality, timestamp ole.VARIANT
+	ole.VariantInit(&value)
+	ole.VariantInit(&quality)
+	ole.VariantInit(&timestamp)
+	defer ole.VariantClear(&value)
+	defer ole.VariantClear(&quality)
+	defer ole.VariantClear(&timestamp)
+
+	if _, err := oleutil.CallMethod(item, "Read", int16(opcSourceCache), &value, &quality, &timestamp); err != nil {
+		return DataItem{}, err
+	}
+
+	result := DataItem{Value: opcValue(&value), Quality: types.QualityBad}
+	if q, ok := toFloat(quality.Value()); ok {
+		result.Quality = int(q)
+	}
+	if t, ok := timestamp.Value().(time.Time); ok {
+		result.Timestamp = t
+	}
+
+	return result, nil
+}
+
+// Subscribe sets the update rate and percent deadband of the group and connects an
+// event sink to its DataChange event, so the server checks the items at the update
+// rate and pushes the ones that changed more than the deadband. The server applies
+// the deadband to analog items with an engineering range
+func (s *opcDataSource) Subscribe(rate time.Duration, deadband float64, changed func(map[string]DataItem)) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("OPC subscribe failed, recovery: %#v", r)
+		}
+	}()
+
+	s.Unsubscribe()
+	opcmutex.Lock()
+	defer opcmutex.Unlock()
+
+	if s.group == nil {
+		return fmt.Errorf("OPC server %s not connected", s.progid)
+	}
+
+	if _, err = oleutil.PutProperty(s.group, "UpdateRate", int32(rate/time.Millisecond)); err != nil {
+		return err
+	}
+	if _, err = oleutil.PutProperty(s.group, "DeadBand", float32(deadband)); err != nil {
+		return err
+	}
+	if _, err = oleutil.PutProperty(s.group, "IsSubscribed", true); err != nil {
+		return err
+	}
+
+	unknown, err := s.group.QueryInterface(ole.IID_IConnectionPointContainer)
+	if err != nil {
+		return err
+	}
+	defer unknown.Release()
+
+	var point *ole.IConnectionPoint
+	container := (*ole.IConnectionPointContainer)(unsafe.Pointer(unknown))
+	if err = container.FindConnectionPoint(opcGroupEventIID, &point); err != nil {
+		return err
+	}
+
+	names := append([]string(nil), s.names...)
+	sink := newOPCEventSink(func(dispid int32, args []ole.VARIANT) {
+		if dispid == opcDataChangeDispID {
+			opcDataChange(names, args, changed)
+		}
+	})
+
+	cookie, err := point.Advise(sink.unknown())
+	if err != nil {
+		sink.release()
+		point.Release()
+		return err
+	}
+
+	s.point, s.cookie, s.sink = point, cookie, sink
+	return nil
+}
+
+// Unsubscribe disconnects the event sink from the group
+func (s *opcDataSource) Unsubscribe() {
+	defer handlePanic("opcDataSource.Unsubscribe")
+	opcmutex.Lock()
+	defer opcmutex.Unlock()
+
+	if s.point == nil {
+		return
+	}
+
+	s.point.Unadvise(s.cookie)
+	s.point.Release()
+	s.sink.release()
+	s.point, s.cookie, s.sink = nil, 0, nil
+
+	if s.group != nil {
+		oleutil.PutProperty(s.group, "IsSubscribed", false)
+	}
+}
+
+// Check returns an error if the server is no longer running, since the DataChange
+// events then just stop
+func (s *opcDataSource) Check() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("OPC server check failed, recovery: %#v", r)
+		}
+	}()
+
+	opcmutex.Lock()
+	defer opcmutex.Unlock()
+	return s.running()
+}
+
+// opcDataChange converts the arguments of a DataChange event, which are TransactionID,
+// NumItems, ClientHandles, ItemValues, Qualities and TimeStamps in reverse order. The
+// client handle of an item is its 1-based position in names
+func opcDataChange(names []string, args []ole.VARIANT, changed func(map[string]DataItem)) {
+	if len(args) != 6 {
+		return
+	}
+
+	handles := opcArrayValues(opcByValue(&args[3]))
+	values := opcArrayValues(opcByValue(&args[2]))
+	qualities := opcArrayValues(opcByValue(&args[1]))
+	timestamps := opcArrayValues(opcByValue(&args[0]))
+
+	items := make(map[string]DataItem, len(handles))
+	for i, h := range handles {
+		handle, ok := toFloat(h)
+		if !ok || handle < 1 || int(handle) > len(names) || i >= len(values) {
+			continue
+		}
+
+		item := DataItem{Value: values[i], Quality: types.QualityBad}
+		if i < len(qualities) {
+			if q, ok := toFloat(qualities[i]); ok {
+				item.Quality = int(q)
+			}
+		}
+		if i < len(timestamps) {
+			if t, ok := timestamps[i].(time.Time); ok {
+				item.Timestamp = t
+			}
+		}
+		items[names[int(handle)-1]] = item
+	}
+
+	if len(items) > 0 {
+		changed(items)
+	}
+}
+
+func (s *opcDataSource) Browse(progid string) (Browser, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	cursor, err := opc.CreateBrowserCursor(progid, []string{"localhost"})
+	if err != nil {
+		return nil, err
+	}
+
+	return &opcBrowser{cursor: cursor}, nil
+}
+
+// Close unsubscribes, releases the items and the group and disconnects from the server
+func (s *opcDataSource) Close() {
+	defer handlePanic("opcDataSource.Close")
+	s.Unsubscribe()
+	opcmutex.Lock()
+	defer opcmutex.Unlock()
+
+	for name, item := range s.tags {
+		item.Release()
+		delete(s.tags, name)
+	}
+	s.names = nil
+
+	if s.items != nil {
+		s.items.Release()
+		s.items = nil
+	}
+
+	if s.group != nil {
+		s.group.Release()
+		s.group = nil
+	}
+
+	if s.groups != nil {
+		oleutil.CallMethod(s.groups, "RemoveAll")
+		s.groups.Release()
+		s.groups = nil
+	}
+
+	if s.server != nil {
+		oleutil.CallMethod(s.server, "Disconnect")
+		s.server.Release()
+		s.server = nil
+	}
+}
+
+// Properties reads the data type, access rights, unit, description and engineering
+// range of an item through the connection of the data source. Properties the server
+// does not have are left empty
+func (s *opcDataSource) Properties(name string) (props ItemProperties, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("OPC item properties failed, recovery: %#v", r)
+		}
+	}()
+
+	opcmutex.Lock()
+	defer opcmutex.Unlock()
+
+	if s.server == nil {
+		return props, fmt.Errorf("OPC server %s not connected", s.progid)
+	}
+
+	ids, err := opcInt32Array(opcPropertyIDs)
+	if err != nil {
+		return props, err
+	}
+	defer ole.VariantClear(ids)
+
+	var values, errors ole.VARIANT
+	ole.VariantInit(&values)
+	ole.VariantInit(&errors)
+	defer ole.VariantClear(&values)
+	defer ole.VariantClear(&errors)
+
+	if _, err = oleutil.CallMethod(s.server, "GetItemProperties", name, int32(len(opcPropertyIDs)), ids, &values, &errors); err != nil {
+		return props, err
+	}
+
+	results := opcArrayValues(&values)
+	codes := opcArrayValues(&errors)
+	for i, id := range opcPropertyIDs {
+		if i >= len(results) || (i < len(codes) && codes[i] != int32(0)) {
+			continue
+		}
+
+		value := results[i]
+		switch id {
+		case opcPropertyDataType:
+			if vt, ok := toFloat(value); ok {
+				props.DataType = int(vt)
+			}
+		case opcPropertyAccessRights:
+			if rights, ok := toFloat(value); ok {
+				props.AccessRights = int(rights)
+			}
+		case opcPropertyUnit:
+			props.Unit, _ = value.(string)
+		case opcPropertyDescription:
+			props.Description, _ = value.(string)
+		case opcPropertyEUHigh:
+			if high, ok := toFloat(value); ok {
+				props.EUHigh = &high
+			}
+		case opcPropertyEULow:
+			if low, ok := toFloat(value); ok {
+				props.EULow = &low
+			}
+		}
+	}
+
+	return props, nil
+}
+
+func opcAutomationServer(progid string) (*ole.IDispatch, error) {
+	unknown, err := oleutil.CreateObject("Graybox.OPC.DAWrapper")
+	if err != nil {
+		return nil, err
+	}
+	defer unknown.Release()
+
+	server, err := unknown.QueryInterface(ole.IID_IDispatch)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = oleutil.CallMethod(server, "Connect", progid, "localhost"); err != nil {
+		server.Release()
+		return nil, err
+	}
+
+	return server, nil
+}
+
+// opcInt32Array returns a VARIANT holding a 1-based array of the values
+func opcInt32Array(values []int32) (*ole.VARIANT, error) {
+	array, _, err := procSafeArrayCreateVector.Call(uintptr(ole.VT_I4), 1, uintptr(len(values)))
+	if array == 0 {
+		return nil, err
+	}
+
+	for i := range values {
+		index := int32(i + 1)
+		if hr, _, _ := procSafeArrayPutElement.Call(array, uintptr(unsafe.Pointer(&index)), uintptr(unsafe.Pointer(&values[i]))); hr != 0 {
+			return nil, ole.NewError(hr)
+		}
+	}
+
+	variant := ole.NewVariant(ole.VT_ARRAY|ole.VT_I4, int64(array))
+	return &variant, nil
+}
+
+// opcArrayValues returns the elements of a VARIANT array regardless of bounds
+func opcArrayValues(v *ole.VARIANT) (values []interface{}) {
+	if v.VT&ole.VT_ARRAY == 0 {
+		return nil
+	}
+
+	array := uintptr(v.Val)
+	var lower, upper int32
+	procSafeArrayGetLBound.Call(array, 1, uintptr(unsafe.Pointer(&lower)))
+	procSafeArrayGetUBound.Call(array, 1, uintptr(unsafe.Pointer(&upper)))
+
+	// Elements are read into a VARIANT of the array's element type. VARIANT and DECIMAL
+	// elements fill the whole VARIANT, other elements fit in its value field
+	elementType := v.VT &^ ole.VT_ARRAY
+	for index := lower; index <= upper; index++ {
+		var element ole.VARIANT
+		ole.VariantInit(&element)
+		target := unsafe.Pointer(&element.Val)
+		if elementType == ole.VT_VARIANT || elementType == ole.VT_DECIMAL {
+			target = unsafe.Pointer(&element)
+		}
+
+		if hr, _, _ := procSafeArrayGetElement.Call(array, uintptr(unsafe.Pointer(&index)), uintptr(target)); hr != 0 {
+			values = append(values, nil)
+			continue
+		}
+
+		if elementType != ole.VT_VARIANT {
+			element.VT = elementType
+		}
+		values = append(values, opcValue(&element))
+		ole.VariantClear(&element)
+	}
+
+	return values
+}
+
+// opcValue converts a VARIANT to a Go value, including the arrays, currency and decimal
+// values VARIANT.Value leaves out
+func opcValue(v *ole.VARIANT) interface{} {
+	switch {
+	case v.VT&ole.VT_ARRAY != 0:
+		return opcArrayValues(v)
+	case v.VT == ole.VT_CY:
+		// 64-bit integer scaled by 10000
+		return types.Decimal{Unscaled: big.NewInt(v.Val), Scale: 4}
+	case v.VT == ole.VT_DECIMAL:
+		// 96-bit integer with scale and sign: reserved (2), scale (1), sign (1), high 32 bits (4), low 64 bits (8)
+		raw := (*[16]byte)(unsafe.Pointer(v))
+		unscaled := new(big.Int).SetUint64(uint64(binary.LittleEndian.Uint32(raw[4:8])))
+		unscaled.Lsh(unscaled, 64).Or(unscaled, new(big.Int).SetUint64(binary.LittleEndian.Uint64(raw[8:16])))
+		if raw[3]&0x80 != 0 {
+			unscaled.Neg(unscaled)
+		}
+		return types.Decimal{Unscaled: unscaled, Scale: int(raw[2])}
+	}
+
+	return v.Value()
+}
+
+func (b *opcBrowser) MoveHome() {
+	opc.MoveCursorHome(b.cursor)
+}
+
+func (b *opcBrowser) MoveTo(branch string) {
+	opc.MoveCursorTo(b.cursor, branch)
+}
+
+func (b *opcBrowser) Position() string {
+	return opc.CursorPosition(b.cursor)
+}
+
+func (b *opcBrowser) Branches() []string {
+	return opc.CursorListBranches(b.cursor)
+}
+
+func (b *opcBrowser) Leaves() []string {
+	return opc.CursorListLeaves(b.cursor)
+}
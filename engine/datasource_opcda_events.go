@@ -0,0 +1,152 @@
+// +build windows
+
+package engine
+
+import (
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"github.com/go-ole/go-ole"
+)
+
+// DIOPCGroupEvent, the event interface of the automation OPCGroup, and the DISPID of
+// its DataChange event
+var opcGroupEventIID = ole.NewGUID("{28E68F97-8D75-11D1-8DC3-3C302A000000}")
+
+const opcDataChangeDispID = 1
+
+// opcEventSink is an IDispatch implemented in Go that receives the events of an
+// OPCGroup. The sink of oleutil.ConnectObject does not pass event arguments, so
+// the methods are implemented here. Events are called on COM threads, the process
+// is in the multithreaded apartment. COM holds pointers to the sink, so it is kept
+// in opcEventSinks until its last reference is released
+type opcEventSink struct {
+	vtbl    *opcEventSinkVtbl // Must be first, COM reads the methods through it
+	refs    int32
+	invoked func(dispid int32, args []ole.VARIANT)
+}
+
+type opcEventSinkVtbl struct {
+	QueryInterface   uintptr
+	AddRef           uintptr
+	Release          uintptr
+	GetTypeInfoCount uintptr
+	GetTypeInfo      uintptr
+	GetIDsOfNames    uintptr
+	Invoke           uintptr
+}
+
+// opcDispParams has the layout of DISPPARAMS, whose fields go-ole does not export
+type opcDispParams struct {
+	args       *ole.VARIANT // In reverse order
+	named      uintptr
+	count      uint32
+	namedCount uint32
+}
+
+// opcVariantRef has the layout of a VARIANT passed by reference
+type opcVariantRef struct {
+	VT       ole.VT
+	reserved [3]uint16
+	ref      *uintptr // Points to the SAFEARRAY pointer of an array
+}
+
+var (
+	opcEventSinkMethods = &opcEventSinkVtbl{
+		QueryInterface:   syscall.NewCallback(opcSinkQueryInterface),
+		AddRef:           syscall.NewCallback(opcSinkAddRef),
+		Release:          syscall.NewCallback(opcSinkRelease),
+		GetTypeInfoCount: syscall.NewCallback(opcSinkGetTypeInfoCount),
+		GetTypeInfo:      syscall.NewCallback(opcSinkNotImplemented3),
+		GetIDsOfNames:    syscall.NewCallback(opcSinkNotImplemented6),
+		Invoke:           syscall.NewCallback(opcSinkInvoke),
+	}
+	opcEventSinks      = map[*opcEventSink]bool{}
+	opcEventSinksMutex sync.Mutex
+)
+
+// newOPCEventSink returns a sink calling invoked for each event, holding one reference
+// that is released by the owner
+func newOPCEventSink(invoked func(dispid int32, args []ole.VARIANT)) *opcEventSink {
+	sink := &opcEventSink{vtbl: opcEventSinkMethods, refs: 1, invoked: invoked}
+	opcEventSinksMutex.Lock()
+	opcEventSinks[sink] = true
+	opcEventSinksMutex.Unlock()
+	return sink
+}
+
+func (sink *opcEventSink) unknown() *ole.IUnknown {
+	return (*ole.IUnknown)(unsafe.Pointer(sink))
+}
+
+func (sink *opcEventSink) release() {
+	opcSinkRelease(sink)
+}
+
+func opcSinkQueryInterface(this *opcEventSink, iid *ole.GUID, object *uintptr) uintptr {
+	if ole.IsEqualGUID(iid, ole.IID_IUnknown) || ole.IsEqualGUID(iid, ole.IID_IDispatch) || ole.IsEqualGUID(iid, opcGroupEventIID) {
+		opcSinkAddRef(this)
+		*object = uintptr(unsafe.Pointer(this))
+		return ole.S_OK
+	}
+
+	*object = 0
+	return ole.E_NOINTERFACE
+}
+
+func opcSinkAddRef(this *opcEventSink) uintptr {
+	return uintptr(atomic.AddInt32(&this.refs, 1))
+}
+
+func opcSinkRelease(this *opcEventSink) uintptr {
+	refs := atomic.AddInt32(&this.refs, -1)
+	if refs == 0 {
+		opcEventSinksMutex.Lock()
+		delete(opcEventSinks, this)
+		opcEventSinksMutex.Unlock()
+	}
+
+	return uintptr(refs)
+}
+
+func opcSinkGetTypeInfoCount(this *opcEventSink, count *uint32) uintptr {
+	*count = 0
+	return ole.S_OK
+}
+
+func opcSinkNotImplemented3(this *opcEventSink, a uintptr, b uintptr, c uintptr) uintptr {
+	return ole.E_NOTIMPL
+}
+
+func opcSinkNotImplemented6(this *opcEventSink, a uintptr, b uintptr, c uintptr, d uintptr, e uintptr) uintptr {
+	return ole.E_NOTIMPL
+}
+
+func opcSinkInvoke(this *opcEventSink, dispid uintptr, iid uintptr, lcid uintptr, flags uintptr, params *opcDispParams, result uintptr, exception uintptr, argerr uintptr) uintptr {
+	defer handlePanic("opcEventSink.Invoke")
+
+	var args []ole.VARIANT
+	if params != nil && params.args != nil && params.count > 0 {
+		args = (*[1 << 16]ole.VARIANT)(unsafe.Pointer(params.args))[:params.count:params.count]
+	}
+
+	this.invoked(int32(dispid), args)
+	return ole.S_OK
+}
+
+// opcByValue returns an array VARIANT passed by reference as a VARIANT holding the
+// array. Arrays are passed to events by reference, other VARIANTs are returned empty
+func opcByValue(v *ole.VARIANT) *ole.VARIANT {
+	if v.VT&ole.VT_BYREF == 0 {
+		return v
+	}
+
+	ref := (*opcVariantRef)(unsafe.Pointer(v))
+	if ref.ref == nil || v.VT&ole.VT_ARRAY == 0 {
+		return &ole.VARIANT{}
+	}
+
+	return &ole.VARIANT{VT: v.VT &^ ole.VT_BYREF, Val: int64(*ref.ref)}
+}
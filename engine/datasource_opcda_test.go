@@ -0,0 +1,118 @@
+// +build windows
+
+package engine
+
+import (
+	"dd-opcda/types"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/go-ole/go-ole"
+)
+
+// opcFloat64Array returns a VARIANT holding a 1-based array of doubles, as servers
+// return array items
+func opcFloat64Array(t *testing.T, values []float64) *ole.VARIANT {
+	array, _, err := procSafeArrayCreateVector.Call(uintptr(ole.VT_R8), 1, uintptr(len(values)))
+	if array == 0 {
+		t.Fatalf("SafeArrayCreateVector failed: %s", err)
+	}
+
+	for i := range values {
+		index := int32(i + 1)
+		if hr, _, _ := procSafeArrayPutElement.Call(array, uintptr(unsafe.Pointer(&index)), uintptr(unsafe.Pointer(&values[i]))); hr != 0 {
+			t.Fatalf("SafeArrayPutElement failed: %s", ole.NewError(hr))
+		}
+	}
+
+	variant := ole.NewVariant(ole.VT_ARRAY|ole.VT_R8, int64(array))
+	return &variant
+}
+
+// opcDecimal returns a VARIANT holding a DECIMAL of a 96-bit unscaled value
+func opcDecimal(high uint32, low uint64, scale byte, negative bool) *ole.VARIANT {
+	var variant ole.VARIANT
+	raw := (*[16]byte)(unsafe.Pointer(&variant))
+	raw[2] = scale
+	if negative {
+		raw[3] = 0x80
+	}
+	binary.LittleEndian.PutUint32(raw[4:8], high)
+	binary.LittleEndian.PutUint64(raw[8:16], low)
+	variant.VT = ole.VT_DECIMAL
+	return &variant
+}
+
+// roundTrip sends a value the way the collector does and returns it as decoded by a
+// receiver of the JSON and of the binary message
+func roundTrip(t *testing.T, value interface{}) (fromJSON interface{}, fromBinary interface{}) {
+	point := types.DataPoint{ID: 1, Time: time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC), Quality: types.QualityGood}
+	point.Value, point.Type = types.EncodeValue(value)
+	msg := &types.DataMessage{Version: 2, Group: "test", Count: 1, Points: []types.DataPoint{point}}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var jsonmsg types.DataMessage
+	if err = json.Unmarshal(data, &jsonmsg); err != nil {
+		t.Fatal(err)
+	}
+	if fromJSON, err = types.DecodeValue(jsonmsg.Points[0].Value, jsonmsg.Points[0].Type); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, err = msg.MarshalBinary(); err != nil {
+		t.Fatal(err)
+	}
+	var binmsg types.DataMessage
+	if err = binmsg.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if fromBinary, err = types.DecodeValue(binmsg.Points[0].Value, binmsg.Points[0].Type); err != nil {
+		t.Fatal(err)
+	}
+
+	return fromJSON, fromBinary
+}
+
+func TestOPCValueRoundTrip(t *testing.T) {
+	currency := ole.NewVariant(ole.VT_CY, -1234567891) // -123456.7891
+	array := opcFloat64Array(t, []float64{1.5, -2.25, math.MaxFloat64})
+	defer ole.VariantClear(array)
+
+	tests := []struct {
+		name    string
+		variant *ole.VARIANT
+		want    interface{}
+	}{
+		{"currency", &currency, "-123456.7891"},
+		{"decimal", opcDecimal(1, 0, 3, false), "18446744073709551.616"},
+		{"negative decimal", opcDecimal(0, 42, 0, true), "-42"},
+		{"double array", array, []interface{}{1.5, -2.25, math.MaxFloat64}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			value := opcValue(test.variant)
+			if value == nil {
+				t.Fatalf("VARIANT type %d converted to nil", test.variant.VT)
+			}
+
+			fromJSON, fromBinary := roundTrip(t, value)
+			for _, got := range []interface{}{value, fromJSON, fromBinary} {
+				if decimal, ok := got.(types.Decimal); ok {
+					got = decimal.String()
+				}
+				if !reflect.DeepEqual(got, test.want) {
+					t.Errorf("got %#v, want %#v", got, test.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,308 @@
+package engine
+
+import (
+	"dd-opcda/types"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	simulatorProgID       = "dd-opcda.Simulator"
+	simulatorQualityGood  = 0xC0
+	simulatorQualityBad   = 0x00
+	simulatorStepLevels   = 5
+	simulatorWalkMaxValue = 100.0
+)
+
+// simulatorItems maps branch to leaves of the simulated item tree. Item IDs are
+// the branch and leaf joined with a '.', for example 'numeric.sine'
+var simulatorItems = map[string][]string{
+	"numeric": {"sine", "sawtooth", "ramp", "randomwalk", "step"},
+	"boolean": {"toggle"},
+	"string":  {"counter"},
+}
+
+type simulatorItem struct {
+	name    string
+	walk    float64
+	counter uint64
+}
+
+type simulatorDataSource struct {
+	items        []*simulatorItem
+	started      time.Time
+	period       time.Duration
+	badquality   float64
+	disconnected bool
+	random       *rand.Rand
+	mutex        sync.Mutex
+	stop         chan struct{}
+}
+
+type simulatorBrowser struct {
+	position string
+}
+
+func init() {
+	RegisterDataSource(DataSourceSimulator, func() DataSource { return &simulatorDataSource{} }, func() []string { return []string{simulatorProgID} })
+}
+
+func (s *simulatorDataSource) Connect(progid string) error {
+	if progid != simulatorProgID {
+		return fmt.Errorf("unknown simulator: %s", progid)
+	}
+
+	s.started = time.Now()
+	s.random = rand.New(rand.NewSource(s.started.UnixNano()))
+
+	seconds, _ := strconv.Atoi(InitSetting("simulator.period", "60", "Period in seconds of simulated waveforms").Value)
+	if seconds < 1 {
+		seconds = 60
+	}
+	s.period = time.Duration(seconds) * time.Second
+
+	s.badquality, _ = strconv.ParseFloat(InitSetting("simulator.badquality", "0", "Percentage of simulated values returned with bad quality").Value, 64)
+	s.disconnected = InitSetting("simulator.disconnected", "0", "1 = all simulated values have bad quality, not connected, as from a server that lost its devices").Value == "1"
+	return nil
+}
+
+func (s *simulatorDataSource) Add(name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	parts := strings.SplitN(name, ".", 2)
+	if len(parts) != 2 || !simulatorHasLeaf(parts[0], parts[1]) {
+		return fmt.Errorf("no such simulator item: %s", name)
+	}
+
+	for _, item := range s.items {
+		if item.name == name {
+			return nil
+		}
+	}
+
+	s.items = append(s.items, &simulatorItem{name: name, walk: simulatorWalkMaxValue / 2})
+	return nil
+}
+
+func (s *simulatorDataSource) Tags() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	names := make([]string, len(s.items))
+	for i, item := range s.items {
+		names[i] = item.name
+	}
+
+	return names
+}
+
+func (s *simulatorDataSource) Read(names []string) (map[string]DataItem, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var wanted map[string]bool
+	if names != nil {
+		wanted = make(map[string]bool, len(names))
+		for _, name := range names {
+			wanted[name] = true
+		}
+	}
+
+	now := time.Now()
+	items := make(map[string]DataItem, len(s.items))
+	for _, item := range s.items {
+		if wanted != nil && !wanted[item.name] {
+			continue
+		}
+
+		quality := simulatorQualityGood
+		if s.disconnected {
+			quality = types.QualityNotConnected
+		} else if s.random.Float64()*100.0 < s.badquality {
+			quality = simulatorQualityBad
+		}
+
+		items[item.name] = DataItem{Value: s.value(item, now), Quality: quality, Timestamp: now}
+	}
+
+	return items, nil
+}
+
+// value computes the current value of a simulated item. Waveforms are derived from
+// the time since connect, while random walk and counters keep state between reads
+func (s *simulatorDataSource) value(item *simulatorItem, now time.Time) interface{} {
+	elapsed := now.Sub(s.started)
+	phase := float64(elapsed%s.period) / float64(s.period)
+
+	switch item.name {
+	case "numeric.sine":
+		return 100.0 * math.Sin(2*math.Pi*phase)
+	case "numeric.sawtooth":
+		return 100.0 * phase
+	case "numeric.ramp":
+		return elapsed.Seconds()
+	case "numeric.randomwalk":
+		item.walk = math.Max(0, math.Min(simulatorWalkMaxValue, item.walk+s.random.NormFloat64()))
+		return item.walk
+	case "numeric.step":
+		step := int64(elapsed/(s.period/simulatorStepLevels)) % simulatorStepLevels
+		return step * 100 / (simulatorStepLevels - 1)
+	case "boolean.toggle":
+		return phase >= 0.5
+	case "string.counter":
+		item.counter++
+		return fmt.Sprintf("count-%d", item.counter)
+	}
+
+	return nil
+}
+
+// Subscribe generates new values at the update rate and pushes those that changed
+// more than the deadband in percent of the simulated item's range
+func (s *simulatorDataSource) Subscribe(rate time.Duration, deadband float64, changed func(map[string]DataItem)) error {
+	s.Unsubscribe()
+	s.stop = make(chan struct{})
+	stop := s.stop
+	filter := newChangeFilter(deadband, simulatorRange)
+
+	go func() {
+		defer handlePanic("simulatorSubscription")
+		ticker := time.NewTicker(rate)
+		defer ticker.Stop()
+
+		for {
+			items, _ := s.Read(nil)
+			if items = filter.filter(items); len(items) > 0 {
+				changed(items)
+			}
+
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (s *simulatorDataSource) Unsubscribe() {
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+}
+
+// Check always succeeds, the simulator can not lose its connection
+func (s *simulatorDataSource) Check() error {
+	return nil
+}
+
+func simulatorRange(name string) (float64, float64, bool) {
+	switch name {
+	case "numeric.sine":
+		return -100, 100, true
+	case "numeric.sawtooth", "numeric.randomwalk", "numeric.step":
+		return 0, 100, true
+	}
+
+	return 0, 0, false
+}
+
+// Properties reports the data type and range of a simulated item like an OPC DA server
+func (s *simulatorDataSource) Properties(name string) (ItemProperties, error) {
+	parts := strings.SplitN(name, ".", 2)
+	if len(parts) != 2 || !simulatorHasLeaf(parts[0], parts[1]) {
+		return ItemProperties{}, fmt.Errorf("no such simulator item: %s", name)
+	}
+
+	props := ItemProperties{AccessRights: 1, Description: fmt.Sprintf("Simulated %s %s", parts[1], parts[0])}
+	switch name {
+	case "boolean.toggle":
+		props.DataType = 11 // VT_BOOL
+	case "string.counter":
+		props.DataType = 8 // VT_BSTR
+	case "numeric.step":
+		props.DataType = 20 // VT_I8
+	default:
+		props.DataType = 5 // VT_R8
+	}
+
+	if low, high, ok := simulatorRange(name); ok {
+		props.EULow, props.EUHigh = &low, &high
+	}
+
+	return props, nil
+}
+
+func (s *simulatorDataSource) Browse(progid string) (Browser, error) {
+	if progid != simulatorProgID {
+		return nil, fmt.Errorf("unknown simulator: %s", progid)
+	}
+
+	return &simulatorBrowser{}, nil
+}
+
+func (s *simulatorDataSource) Close() {
+	s.Unsubscribe()
+	s.mutex.Lock()
+	s.items = nil
+	s.mutex.Unlock()
+}
+
+func simulatorHasLeaf(branch string, leaf string) bool {
+	for _, l := range simulatorItems[branch] {
+		if l == leaf {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (b *simulatorBrowser) MoveHome() {
+	b.position = ""
+}
+
+func (b *simulatorBrowser) MoveTo(branch string) {
+	branch = strings.TrimPrefix(branch, "root.")
+	if branch == "root" {
+		branch = ""
+	}
+
+	b.position = branch
+}
+
+func (b *simulatorBrowser) Position() string {
+	return b.position
+}
+
+func (b *simulatorBrowser) Branches() []string {
+	if b.position != "" {
+		return []string{}
+	}
+
+	branches := make([]string, 0, len(simulatorItems))
+	for branch := range simulatorItems {
+		branches = append(branches, branch)
+	}
+
+	sort.Strings(branches)
+	return branches
+}
+
+func (b *simulatorBrowser) Leaves() []string {
+	if leaves, ok := simulatorItems[b.position]; ok {
+		return leaves
+	}
+
+	return []string{}
+}
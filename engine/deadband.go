@@ -0,0 +1,163 @@
+package engine
+
+import (
+	"dd-opcda/types"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// tagState keeps the report-by-exception state of a collected tag between cycles
+type tagState struct {
+	sent        bool
+	sentValue   interface{}
+	sentQuality int
+	sentTime    time.Time
+	sampleTime  time.Time
+	good        bool        // A value of good quality has been collected
+	goodValue   interface{} // Last value of good quality
+
+	// Frozen and stale detection, see checkStale
+	observed    *DataItem // Last collected item
+	changedTime time.Time
+	goodTime    time.Time
+	flags       int
+}
+
+// maxSilence returns the longest time a deadband may hold back a tag value
+func maxSilence(group *types.OPCGroup) time.Duration {
+	seconds := group.MaxSilence
+	if seconds <= 0 {
+		seconds, _ = strconv.Atoi(InitSetting("deadband.maxsilence", "300", "Max number of seconds a deadband may hold back a tag value").Value)
+		if seconds <= 0 {
+			seconds = 300
+		}
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+// ValidateTag checks the deadband, rate, scaling and expression settings of a tag
+func ValidateTag(tag *types.OPCTag) error {
+	if tag.IntegratingDeadband < 0 || tag.Deadband < 0 {
+		return fmt.Errorf("tag %s: deadbands must not be negative", tag.Name)
+	}
+
+	if tag.RateMultiple < 0 || tag.FrozenAfter < 0 || tag.StaleAfter < 0 {
+		return fmt.Errorf("tag %s: rate multiple and frozen and stale thresholds must not be negative", tag.Name)
+	}
+
+	switch tag.DeadbandType {
+	case types.DeadbandNone, types.DeadbandAbsolute:
+	case types.DeadbandPercent:
+		if tag.EUHigh <= tag.EULow {
+			return fmt.Errorf("tag %s: percent deadband requires an engineering range (euhigh > eulow)", tag.Name)
+		}
+	default:
+		return fmt.Errorf("tag %s: unknown deadband type %d", tag.Name, tag.DeadbandType)
+	}
+
+	if tag.Expression != "" {
+		if _, err := parseExpression(tag.Expression); err != nil {
+			return fmt.Errorf("tag %s: invalid expression: %s", tag.Name, err.Error())
+		}
+	}
+
+	return validateScaling(tag)
+}
+
+// deadband returns the absolute threshold of the tag's absolute or percent deadband
+func deadband(tag *types.OPCTag) float64 {
+	if tag.DeadbandType == types.DeadbandPercent {
+		return tag.Deadband / 100.0 * (tag.EUHigh - tag.EULow)
+	}
+
+	return tag.Deadband
+}
+
+// report returns true if the item should be sent. Numeric values are reported when they
+// moved beyond the tag's absolute or percent deadband, or when tag.Integrator, the integral
+// of the deviation from the last sent value (value * seconds), exceeds tag.IntegratingDeadband.
+// Quality changes always report, and max silence forces a refresh of values held back
+func (s *tagState) report(tag *types.OPCTag, item DataItem, now time.Time, silence time.Duration) bool {
+	defer func() { s.sampleTime = now }()
+
+	if !s.sent || tag == nil || item.Quality != s.sentQuality || now.Sub(s.sentTime) >= silence {
+		return s.update(tag, item, now)
+	}
+
+	if tag.DeadbandType == types.DeadbandNone && tag.IntegratingDeadband <= 0 {
+		return s.update(tag, item, now)
+	}
+
+	value, ok := toFloat(item.Value)
+	sent, sentok := toFloat(s.sentValue)
+	if !ok || !sentok {
+		if !reflect.DeepEqual(item.Value, s.sentValue) {
+			return s.update(tag, item, now)
+		}
+		return false
+	}
+
+	deviation := math.Abs(value - sent)
+	if tag.DeadbandType != types.DeadbandNone && deviation > deadband(tag) {
+		return s.update(tag, item, now)
+	}
+
+	if tag.IntegratingDeadband > 0 {
+		tag.Integrator += deviation * now.Sub(s.sampleTime).Seconds()
+		if tag.Integrator >= tag.IntegratingDeadband {
+			return s.update(tag, item, now)
+		}
+	}
+
+	return false
+}
+
+func (s *tagState) update(tag *types.OPCTag, item DataItem, now time.Time) bool {
+	s.sent = true
+	s.sentValue = item.Value
+	s.sentQuality = item.Quality
+	s.sentTime = now
+	if tag != nil {
+		tag.Integrator = 0
+	}
+
+	return true
+}
+
+// toFloat converts numeric values to float64
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case types.Decimal:
+		return n.Float64(), true
+	}
+
+	return 0, false
+}
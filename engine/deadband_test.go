@@ -0,0 +1,131 @@
+package engine
+
+import (
+	"dd-opcda/types"
+	"testing"
+	"time"
+)
+
+// deadbandStep is an item collected a number of seconds into a test, and whether it
+// is reported
+type deadbandStep struct {
+	seconds int
+	value   interface{}
+	quality int
+	report  bool
+}
+
+func runDeadband(t *testing.T, tag *types.OPCTag, steps []deadbandStep) {
+	t.Helper()
+	start := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	state := &tagState{}
+	for i, step := range steps {
+		item := DataItem{Value: step.value, Quality: step.quality, Timestamp: start}
+		if got := state.report(tag, item, start.Add(time.Duration(step.seconds)*time.Second), time.Minute); got != step.report {
+			t.Errorf("step %d (%v at %d s): reported %v, want %v", i, step.value, step.seconds, got, step.report)
+		}
+	}
+}
+
+func TestDeadbandNone(t *testing.T) {
+	runDeadband(t, &types.OPCTag{}, []deadbandStep{
+		{0, 1.0, 0xC0, true},
+		{1, 1.0, 0xC0, true},
+		{2, 1.0001, 0xC0, true},
+	})
+}
+
+func TestDeadbandAbsolute(t *testing.T) {
+	tag := &types.OPCTag{DeadbandType: types.DeadbandAbsolute, Deadband: 1}
+	runDeadband(t, tag, []deadbandStep{
+		{0, 10.0, 0xC0, true},
+		{1, 10.5, 0xC0, false},
+		{2, 9.0, 0xC0, false}, // At the deadband
+		{3, 11.5, 0xC0, true}, // Beyond it, from the last sent value
+		{4, 12.0, 0xC0, false},
+		{5, 12.0, 0x00, true}, // Quality changes always report
+		{6, int32(12), 0x00, false},
+		{7, int32(14), 0x00, true},
+	})
+}
+
+func TestDeadbandPercent(t *testing.T) {
+	// 10 % of 0 to 50 is 5
+	tag := &types.OPCTag{DeadbandType: types.DeadbandPercent, Deadband: 10, EULow: 0, EUHigh: 50}
+	runDeadband(t, tag, []deadbandStep{
+		{0, 20.0, 0xC0, true},
+		{1, 24.0, 0xC0, false},
+		{2, 15.5, 0xC0, false},
+		{3, 25.5, 0xC0, true},
+	})
+}
+
+func TestDeadbandIntegrating(t *testing.T) {
+	// A deviation of 2 integrates to 10 in 5 seconds
+	tag := &types.OPCTag{IntegratingDeadband: 10}
+	runDeadband(t, tag, []deadbandStep{
+		{0, 0.0, 0xC0, true},
+		{1, 2.0, 0xC0, false},
+		{2, 2.0, 0xC0, false},
+		{3, 2.0, 0xC0, false},
+		{4, 2.0, 0xC0, false},
+		{5, 2.0, 0xC0, true},
+		{6, 2.0, 0xC0, false}, // No deviation from the sent value
+		{26, 2.0, 0xC0, false},
+	})
+	if tag.Integrator != 0 {
+		t.Errorf("integrator %f, want 0 without deviation", tag.Integrator)
+	}
+
+	// The absolute deadband still reports large steps before the integral is reached
+	tag = &types.OPCTag{DeadbandType: types.DeadbandAbsolute, Deadband: 5, IntegratingDeadband: 100}
+	runDeadband(t, tag, []deadbandStep{
+		{0, 0.0, 0xC0, true},
+		{1, 4.0, 0xC0, false},
+		{2, 6.0, 0xC0, true},
+	})
+}
+
+func TestDeadbandMaxSilence(t *testing.T) {
+	tag := &types.OPCTag{DeadbandType: types.DeadbandAbsolute, Deadband: 100}
+	runDeadband(t, tag, []deadbandStep{
+		{0, 1.0, 0xC0, true},
+		{30, 2.0, 0xC0, false},
+		{60, 3.0, 0xC0, true}, // Held back for the max silence of a minute
+		{90, 3.0, 0xC0, false},
+	})
+}
+
+func TestDeadbandNotNumeric(t *testing.T) {
+	tag := &types.OPCTag{DeadbandType: types.DeadbandAbsolute, Deadband: 1}
+	runDeadband(t, tag, []deadbandStep{
+		{0, "on", 0xC0, true},
+		{1, "on", 0xC0, false},
+		{2, "off", 0xC0, true},
+		{3, []float64{1, 2}, 0xC0, true},
+		{4, []float64{1, 2}, 0xC0, false},
+	})
+}
+
+func TestValidateTagDeadband(t *testing.T) {
+	tests := []struct {
+		name string
+		tag  types.OPCTag
+		ok   bool
+	}{
+		{"none", types.OPCTag{}, true},
+		{"absolute", types.OPCTag{DeadbandType: types.DeadbandAbsolute, Deadband: 0.5}, true},
+		{"percent", types.OPCTag{DeadbandType: types.DeadbandPercent, Deadband: 1, EUHigh: 100}, true},
+		{"percent without range", types.OPCTag{DeadbandType: types.DeadbandPercent, Deadband: 1}, false},
+		{"negative", types.OPCTag{DeadbandType: types.DeadbandAbsolute, Deadband: -1}, false},
+		{"negative integrating", types.OPCTag{IntegratingDeadband: -1}, false},
+		{"unknown type", types.OPCTag{DeadbandType: 99}, false},
+	}
+
+	for _, test := range tests {
+		test.tag.Name = test.name
+		if err := ValidateTag(&test.tag); (err == nil) != test.ok {
+			t.Errorf("%s: err %v", test.name, err)
+		}
+	}
+}
@@ -1,13 +1,27 @@
 package engine
 
 import (
+	"dd-opcda/fec"
 	"dd-opcda/logger"
+	"dd-opcda/sign"
 	"dd-opcda/types"
 	"fmt"
 	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	channelData = iota
+	channelMeta = iota
+	channelFile = iota
 )
 
 var proxies map[uint]*types.DiodeProxy
+var healthMutex sync.Mutex
 
 func initProxy(proxy *types.DiodeProxy) (err error) {
 	// Initialize channels and UDP sinks
@@ -16,15 +30,20 @@ func initProxy(proxy *types.DiodeProxy) (err error) {
 		proxies = map[uint]*types.DiodeProxy{}
 	}
 
+	proxy.Health.Healthy = true
+	queue := proxyQueueSize()
+	proxy.Keyring = sign.NewKeyring()
+
 	// DATA
 	target := fmt.Sprintf("%s:%d", proxy.EndpointIP, proxy.DataPort)
 	proxy.DataCon, err = net.Dial("udp", target)
 	if proxy.DataCon == nil {
 		logger.Log("error", "Failed to open data emitter", fmt.Sprintf("UDP data emitter to IP: %s could not be opened, error: %s", target, err.Error()))
+		proxy.Health.Healthy = false
 	} else {
 		logger.Log("trace", "Setting up outgoing DATA", target)
-		proxy.DataChan = make(chan []byte)
-		go sendJob(proxy.DataChan, proxy.DataCon)
+		proxy.DataChan = make(chan []byte, queue)
+		go sendJob(proxy, proxy.DataChan, proxy.DataCon)
 	}
 
 	// META
@@ -32,10 +51,11 @@ func initProxy(proxy *types.DiodeProxy) (err error) {
 	proxy.MetaCon, err = net.Dial("udp", target)
 	if proxy.MetaCon == nil {
 		logger.Log("error", "Failed to open meta emitter", fmt.Sprintf("UDP meta emitter to IP: %s could not be opened, error: %s", target, err.Error()))
+		proxy.Health.Healthy = false
 	} else {
 		logger.Log("trace", "Setting up outgoing META", target)
-		proxy.MetaChan = make(chan []byte)
-		go sendJob(proxy.MetaChan, proxy.MetaCon)
+		proxy.MetaChan = make(chan []byte, queue)
+		go sendJob(proxy, proxy.MetaChan, proxy.MetaCon)
 	}
 
 	// FILES
@@ -43,10 +63,11 @@ func initProxy(proxy *types.DiodeProxy) (err error) {
 	proxy.FileCon, err = net.Dial("udp", target)
 	if proxy.FileCon == nil {
 		logger.Log("error", "Failed to open file emitter", fmt.Sprintf("UDP file emitter to IP: %s could not be opened, error: %s", target, err.Error()))
+		proxy.Health.Healthy = false
 	} else {
 		logger.Log("trace", "Setting up outgoing FILE", target)
-		proxy.MetaChan = make(chan []byte)
-		go sendJob(proxy.FileChan, proxy.FileCon)
+		proxy.FileChan = make(chan []byte, queue)
+		go sendJob(proxy, proxy.FileChan, proxy.FileCon)
 	}
 
 	logger.Trace("Proxy", "Proxy with ID %d initialized", proxy.ID)
@@ -55,18 +76,263 @@ func initProxy(proxy *types.DiodeProxy) (err error) {
 	return err
 }
 
-func sendJob(channel chan []byte, connection net.Conn) {
+// sendJob writes the packets of a channel to its connection. Packets are signed if the
+// proxy has signing keys. With forward error correction, each signed packet gets an FEC
+// header and a parity packet is written after every group, or when a group has been
+// incomplete for the max delay
+func sendJob(proxy *types.DiodeProxy, channel chan []byte, connection net.Conn) {
+	var encoder *fec.Encoder
+	var delay time.Duration
+	if proxy.FECGroupSize > 0 {
+		encoder = fec.NewEncoder(proxy.FECGroupSize)
+		ms, _ := strconv.Atoi(InitSetting("fec.maxdelay", "1000", "Max milliseconds the parity packet of an incomplete FEC group is held back").Value)
+		delay = time.Duration(ms) * time.Millisecond
+	}
+
+	var flush *time.Timer
+	var flushed <-chan time.Time
 	for {
-		data := <-channel
-		if _, err := connection.Write(data); err != nil {
-			logger.Error("Proxy", "Failed to send %#v, error: %s", data, err.Error())
+		var packets [][]byte
+		select {
+		case data := <-channel:
+			data, err := signPacket(proxy, data)
+			if err != nil {
+				updateHealth(proxy, err)
+				continue
+			}
+
+			packets = [][]byte{data}
+			if encoder != nil {
+				packets = encoder.Encode(data)
+			}
+		case <-flushed:
+			packets = [][]byte{encoder.Flush()}
+			flush, flushed = nil, nil
+		}
+
+		if encoder != nil && encoder.Pending() && flush == nil {
+			flush = time.NewTimer(delay)
+			flushed = flush.C
+		} else if encoder != nil && !encoder.Pending() && flush != nil {
+			flush.Stop()
+			flush, flushed = nil, nil
+		}
+
+		for _, packet := range packets {
+			if packet == nil {
+				continue
+			}
+
+			_, err := connection.Write(packet)
+			if err != nil {
+				logger.Error("Proxy", "Failed to send %#v, error: %s", packet, err.Error())
+			}
+			updateHealth(proxy, err)
 		}
 	}
 }
 
+func updateHealth(proxy *types.DiodeProxy, err error) {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+
+	healthy := err == nil
+	if healthy {
+		proxy.Health.Sent++
+		proxy.Health.LastSent = time.Now().UTC()
+	} else {
+		proxy.Health.Failed++
+		proxy.Health.LastError = err.Error()
+	}
+
+	if healthy != proxy.Health.Healthy {
+		proxy.Health.Healthy = healthy
+		logger.NotifySubscribers("proxy.health", proxy)
+	}
+}
+
+// send queues the same packet on the channel of every proxy in the route, so that
+// redundant paths carry identical packets (and sequence numbers) the receiver can
+// de-duplicate. Packets are dropped, and counted in the proxy's health, when a queue
+// is full. It returns the number of paths the packet was handed to
+func send(route []*types.DiodeProxy, channel int, data []byte) (count int) {
+	return sendWait(route, channel, data, 0)
+}
+
+// sendWait is send, waiting up to timeout for room in a full queue before the packet
+// is dropped for that proxy
+func sendWait(route []*types.DiodeProxy, channel int, data []byte, timeout time.Duration) (count int) {
+	for _, proxy := range route {
+		var ch chan []byte
+		switch channel {
+		case channelData:
+			ch = proxy.DataChan
+		case channelMeta:
+			ch = proxy.MetaChan
+		case channelFile:
+			ch = proxy.FileChan
+		}
+
+		if ch == nil {
+			updateHealth(proxy, fmt.Errorf("no emitter for channel %d", channel))
+			continue
+		}
+
+		// A full queue means the path is slow or stuck, which must not hold up the others
+		select {
+		case ch <- data:
+			count++
+			continue
+		default:
+		}
+
+		if timeout > 0 {
+			timer := time.NewTimer(timeout)
+			select {
+			case ch <- data:
+				count++
+				timer.Stop()
+				continue
+			case <-timer.C:
+			}
+		}
+
+		dropPacket(proxy, channel)
+	}
+
+	return
+}
+
+// dropPacket counts a packet that was dropped because the proxy's send queue was full
+func dropPacket(proxy *types.DiodeProxy, channel int) {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+
+	proxy.Health.Dropped++
+	proxy.Health.LastError = fmt.Sprintf("send queue of channel %d is full, packet dropped", channel)
+	if proxy.Health.Healthy {
+		proxy.Health.Healthy = false
+		logger.NotifySubscribers("proxy.health", proxy)
+	}
+}
+
+func proxyQueueSize() int {
+	size, _ := strconv.Atoi(InitSetting("proxy.queuesize", "1000", "Number of packets queued per proxy and channel before packets are dropped").Value)
+	if size < 1 {
+		size = 1000
+	}
+
+	return size
+}
+
+// FirstProxy returns the proxy with the lowest ID, which is the default proxy
 func FirstProxy() *types.DiodeProxy {
-	for _, p := range proxies {
-		return p
+	ids := make([]int, 0, len(proxies))
+	for id := range proxies {
+		ids = append(ids, int(id))
+	}
+
+	if len(ids) == 0 {
+		return nil
 	}
-	return nil
+
+	sort.Ints(ids)
+	return proxies[uint(ids[0])]
+}
+
+func GetProxy(id uint) *types.DiodeProxy {
+	return proxies[id]
+}
+
+// GetProxies returns the initialized proxies, including their health, ordered by ID
+func GetProxies() []*types.DiodeProxy {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+
+	items := make([]*types.DiodeProxy, 0, len(proxies))
+	for _, proxy := range proxies {
+		item := *proxy
+		items = append(items, &item)
+	}
+
+	sort.Slice(items, func(i, j int) bool { return items[i].ID < items[j].ID })
+	return items
+}
+
+// groupProxy returns the proxy a group is configured to send through, or the default
+// proxy if the group has none or it is not initialized
+func groupProxy(group *types.OPCGroup) *types.DiodeProxy {
+	if proxy := GetProxy(group.DiodeProxyID); proxy != nil {
+		return proxy
+	}
+
+	return FirstProxy()
+}
+
+// proxyRoute returns the primary proxy followed by the redundant proxies configured
+// for the whole engine in the 'proxy.redundant' setting
+func proxyRoute(primary *types.DiodeProxy) (route []*types.DiodeProxy) {
+	if primary != nil {
+		route = append(route, primary)
+	}
+
+	setting := InitSetting("proxy.redundant", "", "Comma separated IDs of proxies that all data, meta and files are also sent through")
+	for _, field := range strings.Split(setting.Value, ",") {
+		if id, err := strconv.Atoi(strings.TrimSpace(field)); err == nil {
+			route = appendProxy(route, GetProxy(uint(id)))
+		}
+	}
+
+	return route
+}
+
+// groupRoute returns every proxy a group sends its data and meta through
+func groupRoute(group *types.OPCGroup) []*types.DiodeProxy {
+	route := proxyRoute(groupProxy(group))
+	for _, redundant := range group.RedundantProxies {
+		route = appendProxy(route, GetProxy(redundant.ID))
+	}
+
+	return route
+}
+
+func appendProxy(route []*types.DiodeProxy, proxy *types.DiodeProxy) []*types.DiodeProxy {
+	if proxy == nil {
+		return route
+	}
+
+	for _, p := range route {
+		if p == proxy {
+			return route
+		}
+	}
+
+	return append(route, proxy)
+}
+
+// maxDatagramSize returns the max number of bytes of UDP payload sent through a proxy
+func maxDatagramSize(proxy *types.DiodeProxy) int {
+	size := proxy.MaxDatagramSize
+	if size <= 0 {
+		size, _ = strconv.Atoi(InitSetting("proxy.maxdatagramsize", "1472", "Max bytes of UDP payload in a data packet, 1472 fits an Ethernet MTU of 1500 without fragmentation").Value)
+		if size <= 0 {
+			size = 1472
+		}
+	}
+
+	return size
+}
+
+// payloadSize returns the max number of bytes of a data message in a datagram of size
+// bytes sent through a proxy, which is less the signature and the FEC header. Signing
+// keys are reloaded while the proxy is in use, so the result can change
+func payloadSize(proxy *types.DiodeProxy, size int) int {
+	if proxy.Keyring != nil && proxy.Keyring.Len() > 0 {
+		size -= sign.Overhead
+	}
+	if proxy.FECGroupSize > 0 {
+		size -= fec.HeaderSize
+	}
+
+	return size
 }
@@ -0,0 +1,526 @@
+package engine
+
+import (
+	"dd-opcda/db"
+	"dd-opcda/types"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Expressions of calculated tags are infix expressions over the other tags of a group:
+//
+//	numbers and true/false, tag references (names of letters, digits, '_', '.' and ':'
+//	or any name in braces, e.g. {Area 1/Flow}), + - * / % < <= > >= == != && || ! and
+//	parentheses, and the functions min, max, sum, avg, abs, if(cond, then, else) and
+//	rate(x), the change of x per second since the previous evaluation
+//
+// Booleans are 1 and 0 in arithmetic, and numbers are true when not 0.
+
+const (
+	exprNumber = iota
+	exprName
+	exprOperator
+	exprEnd
+)
+
+var exprPrecedence = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"==": 3, "!=": 3,
+	"<": 4, "<=": 4, ">": 4, ">=": 4,
+	"+": 5, "-": 5,
+	"*": 6, "/": 6, "%": 6,
+}
+
+const exprUnaryPrecedence = 7
+
+// exprArity is the number of arguments of each function, -1 for one or more
+var exprArity = map[string]int{
+	"min":  -1,
+	"max":  -1,
+	"sum":  -1,
+	"avg":  -1,
+	"abs":  1,
+	"if":   3,
+	"rate": 1,
+}
+
+type exprToken struct {
+	kind int
+	text string
+	pos  int
+}
+
+// expression is a parsed calculated tag expression
+type expression struct {
+	source string
+	root   exprNode
+	refs   []string
+}
+
+// exprEnv is what an expression is evaluated against. Quality and Timestamp of the
+// result are the worst quality and the latest timestamp of the referenced items
+type exprEnv struct {
+	items     map[string]DataItem
+	now       time.Time
+	quality   int
+	timestamp time.Time
+}
+
+type exprNode interface {
+	eval(env *exprEnv) (interface{}, error)
+}
+
+type numberNode struct{ value float64 }
+type boolNode struct{ value bool }
+type refNode struct{ name string }
+
+type unaryNode struct {
+	op string
+	x  exprNode
+}
+
+type binaryNode struct {
+	op    string
+	left  exprNode
+	right exprNode
+}
+
+type callNode struct {
+	fn   string
+	args []exprNode
+	prev *float64 // rate: value and time of the previous evaluation
+	time time.Time
+}
+
+// ValidateExpression checks that the expression of a calculated tag only refers to
+// the tags in names, the tags of its group mapped to whether they are calculated
+func ValidateExpression(tag *types.OPCTag, names map[string]bool) error {
+	e, err := parseExpression(tag.Expression)
+	if err != nil {
+		return fmt.Errorf("tag %s: invalid expression: %s", tag.Name, err.Error())
+	}
+
+	for _, ref := range e.refs {
+		calculated, ok := names[ref]
+		if !ok || ref == tag.Name {
+			return fmt.Errorf("tag %s: expression refers to %s, which is not another tag in the group", tag.Name, ref)
+		}
+		if calculated {
+			return fmt.Errorf("tag %s: expression refers to %s, which is also a calculated tag", tag.Name, ref)
+		}
+	}
+
+	return nil
+}
+
+// GroupTagNames returns the names of the tags in each group, mapped to whether they are
+// calculated tags
+func GroupTagNames() map[uint]map[string]bool {
+	var tags []*types.OPCTag
+	db.DB.Table("opc_tags").Where("deleted_at is null").Select("name", "group_id", "expression").Find(&tags)
+
+	groups := map[uint]map[string]bool{}
+	for _, tag := range tags {
+		if groups[tag.GroupID] == nil {
+			groups[tag.GroupID] = map[string]bool{}
+		}
+		groups[tag.GroupID][tag.Name] = tag.Expression != ""
+	}
+
+	return groups
+}
+
+// parseExpression parses the expression of a calculated tag
+func parseExpression(source string) (*expression, error) {
+	tokens, err := lexExpression(source)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &exprParser{tokens: tokens, refs: map[string]bool{}}
+	root, err := p.parse(0)
+	if err != nil {
+		return nil, err
+	}
+
+	if tok := p.peek(); tok.kind != exprEnd {
+		return nil, fmt.Errorf("unexpected '%s' at position %d", tok.text, tok.pos+1)
+	}
+
+	e := &expression{source: source, root: root}
+	for name := range p.refs {
+		e.refs = append(e.refs, name)
+	}
+	sort.Strings(e.refs)
+
+	return e, nil
+}
+
+// evaluate computes the value of the expression from the latest items of the group
+func (e *expression) evaluate(items map[string]DataItem, now time.Time) (DataItem, error) {
+	env := &exprEnv{items: items, now: now, quality: 0xFF}
+	value, err := e.root.eval(env)
+	if err != nil {
+		return DataItem{Quality: 0, Timestamp: now}, err
+	}
+
+	if env.timestamp.IsZero() {
+		env.timestamp = now
+	}
+	if env.quality == 0xFF { // No tags referenced
+		env.quality = 0xC0
+	}
+
+	return DataItem{Value: value, Quality: env.quality, Timestamp: env.timestamp}, nil
+}
+
+func lexExpression(source string) (tokens []exprToken, err error) {
+	runes := []rune(source)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case unicode.IsDigit(r) || (r == '.' && i+1 < len(runes) && unicode.IsDigit(runes[i+1])):
+			start := i
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.' || runes[i] == 'e' || runes[i] == 'E' ||
+				((runes[i] == '-' || runes[i] == '+') && (runes[i-1] == 'e' || runes[i-1] == 'E'))) {
+				i++
+			}
+			tokens = append(tokens, exprToken{kind: exprNumber, text: string(runes[start:i]), pos: start})
+		case unicode.IsLetter(r) || r == '_':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || strings.ContainsRune("_.:", runes[i])) {
+				i++
+			}
+			tokens = append(tokens, exprToken{kind: exprName, text: string(runes[start:i]), pos: start})
+		case r == '{':
+			end := i + 1
+			for end < len(runes) && runes[end] != '}' {
+				end++
+			}
+			if end == len(runes) {
+				return nil, fmt.Errorf("missing '}' for tag name at position %d", i+1)
+			}
+			tokens = append(tokens, exprToken{kind: exprName, text: "{" + string(runes[i+1:end]), pos: i})
+			i = end + 1
+		default:
+			op := string(r)
+			if i+1 < len(runes) {
+				if two := string(runes[i : i+2]); exprPrecedence[two] > 0 {
+					op = two
+				}
+			}
+			if exprPrecedence[op] == 0 && !strings.Contains("!(),", op) {
+				return nil, fmt.Errorf("unexpected '%s' at position %d", op, i+1)
+			}
+			tokens = append(tokens, exprToken{kind: exprOperator, text: op, pos: i})
+			i += len([]rune(op))
+		}
+	}
+
+	return append(tokens, exprToken{kind: exprEnd, text: "end of expression", pos: len(runes)}), nil
+}
+
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+	refs   map[string]bool
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() exprToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != exprEnd {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *exprParser) expect(text string) error {
+	if tok := p.next(); tok.kind != exprOperator || tok.text != text {
+		return fmt.Errorf("expected '%s' at position %d, found '%s'", text, tok.pos+1, tok.text)
+	}
+	return nil
+}
+
+// parse parses operators binding tighter than precedence (Pratt parsing)
+func (p *exprParser) parse(precedence int) (exprNode, error) {
+	left, err := p.prefix()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		tok := p.peek()
+		prec := exprPrecedence[tok.text]
+		if tok.kind != exprOperator || prec <= precedence {
+			return left, nil
+		}
+
+		p.next()
+		right, err := p.parse(prec)
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: tok.text, left: left, right: right}
+	}
+}
+
+func (p *exprParser) prefix() (exprNode, error) {
+	tok := p.next()
+	switch tok.kind {
+	case exprNumber:
+		value, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number '%s' at position %d", tok.text, tok.pos+1)
+		}
+		return &numberNode{value: value}, nil
+	case exprName:
+		if strings.HasPrefix(tok.text, "{") {
+			return p.ref(strings.TrimPrefix(tok.text, "{"))
+		}
+		if tok.text == "true" || tok.text == "false" {
+			return &boolNode{value: tok.text == "true"}, nil
+		}
+		if next := p.peek(); next.kind == exprOperator && next.text == "(" {
+			return p.call(tok)
+		}
+		return p.ref(tok.text)
+	case exprOperator:
+		switch tok.text {
+		case "(":
+			node, err := p.parse(0)
+			if err != nil {
+				return nil, err
+			}
+			return node, p.expect(")")
+		case "-", "!":
+			x, err := p.parse(exprUnaryPrecedence)
+			if err != nil {
+				return nil, err
+			}
+			return &unaryNode{op: tok.text, x: x}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unexpected '%s' at position %d", tok.text, tok.pos+1)
+}
+
+func (p *exprParser) ref(name string) (exprNode, error) {
+	if name == "" {
+		return nil, fmt.Errorf("empty tag name")
+	}
+
+	p.refs[name] = true
+	return &refNode{name: name}, nil
+}
+
+func (p *exprParser) call(fn exprToken) (exprNode, error) {
+	arity, ok := exprArity[fn.text]
+	if !ok {
+		return nil, fmt.Errorf("unknown function '%s' at position %d", fn.text, fn.pos+1)
+	}
+
+	p.next() // (
+	node := &callNode{fn: fn.text}
+	if tok := p.peek(); tok.kind != exprOperator || tok.text != ")" {
+		for {
+			arg, err := p.parse(0)
+			if err != nil {
+				return nil, err
+			}
+			node.args = append(node.args, arg)
+
+			if tok := p.peek(); tok.kind == exprOperator && tok.text == "," {
+				p.next()
+				continue
+			}
+			break
+		}
+	}
+
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+
+	if (arity < 0 && len(node.args) == 0) || (arity >= 0 && len(node.args) != arity) {
+		return nil, fmt.Errorf("wrong number of arguments to '%s' at position %d", fn.text, fn.pos+1)
+	}
+
+	return node, nil
+}
+
+func (n *numberNode) eval(env *exprEnv) (interface{}, error) {
+	return n.value, nil
+}
+
+func (n *boolNode) eval(env *exprEnv) (interface{}, error) {
+	return n.value, nil
+}
+
+func (n *refNode) eval(env *exprEnv) (interface{}, error) {
+	item, ok := env.items[n.name]
+	if !ok {
+		return nil, fmt.Errorf("no value for tag %s", n.name)
+	}
+
+	if item.Quality < env.quality {
+		env.quality = item.Quality
+	}
+	if item.Timestamp.After(env.timestamp) {
+		env.timestamp = item.Timestamp
+	}
+
+	if b, ok := item.Value.(bool); ok {
+		return b, nil
+	}
+	if value, ok := toFloat(item.Value); ok {
+		return value, nil
+	}
+
+	return nil, fmt.Errorf("tag %s is not numeric or boolean", n.name)
+}
+
+func (n *unaryNode) eval(env *exprEnv) (interface{}, error) {
+	x, err := n.x.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	if n.op == "!" {
+		return !exprBool(x), nil
+	}
+
+	return -exprFloat(x), nil
+}
+
+func (n *binaryNode) eval(env *exprEnv) (interface{}, error) {
+	l, err := n.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	r, err := n.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "||":
+		return exprBool(l) || exprBool(r), nil
+	case "&&":
+		return exprBool(l) && exprBool(r), nil
+	}
+
+	a, b := exprFloat(l), exprFloat(r)
+	switch n.op {
+	case "==":
+		return a == b, nil
+	case "!=":
+		return a != b, nil
+	case "<":
+		return a < b, nil
+	case "<=":
+		return a <= b, nil
+	case ">":
+		return a > b, nil
+	case ">=":
+		return a >= b, nil
+	case "+":
+		return a + b, nil
+	case "-":
+		return a - b, nil
+	case "*":
+		return a * b, nil
+	case "/", "%":
+		if b == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		if n.op == "%" {
+			return math.Mod(a, b), nil
+		}
+		return a / b, nil
+	}
+
+	return nil, fmt.Errorf("unknown operator %s", n.op)
+}
+
+func (n *callNode) eval(env *exprEnv) (interface{}, error) {
+	args := make([]float64, len(n.args))
+	for i, arg := range n.args {
+		if n.fn == "if" && i > 0 {
+			break // Only the selected branch is evaluated
+		}
+
+		value, err := arg.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = exprFloat(value)
+	}
+
+	switch n.fn {
+	case "min", "max", "sum", "avg":
+		result := args[0]
+		for _, arg := range args[1:] {
+			switch n.fn {
+			case "min":
+				result = math.Min(result, arg)
+			case "max":
+				result = math.Max(result, arg)
+			default:
+				result += arg
+			}
+		}
+		if n.fn == "avg" {
+			result /= float64(len(args))
+		}
+		return result, nil
+	case "abs":
+		return math.Abs(args[0]), nil
+	case "if":
+		if args[0] != 0 {
+			return n.args[1].eval(env)
+		}
+		return n.args[2].eval(env)
+	case "rate":
+		rate := 0.0
+		if n.prev != nil && env.now.After(n.time) {
+			rate = (args[0] - *n.prev) / env.now.Sub(n.time).Seconds()
+		}
+		value := args[0]
+		n.prev, n.time = &value, env.now
+		return rate, nil
+	}
+
+	return nil, fmt.Errorf("unknown function %s", n.fn)
+}
+
+func exprFloat(v interface{}) float64 {
+	if b, ok := v.(bool); ok {
+		if b {
+			return 1
+		}
+		return 0
+	}
+
+	f, _ := v.(float64)
+	return f
+}
+
+func exprBool(v interface{}) bool {
+	if b, ok := v.(bool); ok {
+		return b
+	}
+
+	return exprFloat(v) != 0
+}
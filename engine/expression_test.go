@@ -0,0 +1,204 @@
+package engine
+
+import (
+	"dd-opcda/types"
+	"testing"
+	"time"
+)
+
+var exprTime = time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+
+func exprItems() map[string]DataItem {
+	return map[string]DataItem{
+		"flow":        {Value: 12.5, Quality: 0xC0, Timestamp: exprTime},
+		"Area1.Level": {Value: int16(4), Quality: 0xC0, Timestamp: exprTime},
+		"Area 1/Pump": {Value: true, Quality: 0xC0, Timestamp: exprTime},
+		"zero":        {Value: uint8(0), Quality: 0xC0, Timestamp: exprTime},
+		"text":        {Value: "on", Quality: 0xC0, Timestamp: exprTime},
+	}
+}
+
+func TestExpressionEvaluate(t *testing.T) {
+	tests := []struct {
+		source string
+		want   interface{}
+	}{
+		{"1 + 2 * 3", 7.0},
+		{"(1 + 2) * 3", 9.0},
+		{"10 - 4 - 3", 3.0},
+		{"-2 * -3", 6.0},
+		{"7 % 4", 3.0},
+		{"1.5e2 / 3", 50.0},
+		{".5 + .25", 0.75},
+		{"flow * 2", 25.0},
+		{"flow + Area1.Level", 16.5},
+		{"{Area 1/Pump} && flow > 10", true},
+		{"!{Area 1/Pump} || zero", false},
+		{"{Area 1/Pump} + 1", 2.0},
+		{"flow >= 12.5 && Area1.Level != 4", false},
+		{"1 < 2 == true", true},
+		{"min(flow, Area1.Level, 8)", 4.0},
+		{"max(flow, 3)", 12.5},
+		{"sum(1, 2, 3)", 6.0},
+		{"avg(flow, 7.5)", 10.0},
+		{"abs(zero - flow)", 12.5},
+		{"if(zero, 1 / zero, flow)", 12.5}, // Only the selected branch is evaluated
+		{"if(flow > 0, true, false)", true},
+	}
+
+	for _, test := range tests {
+		e, err := parseExpression(test.source)
+		if err != nil {
+			t.Errorf("%s: %s", test.source, err)
+			continue
+		}
+
+		item, err := e.evaluate(exprItems(), exprTime)
+		if err != nil {
+			t.Errorf("%s: %s", test.source, err)
+			continue
+		}
+		if item.Value != test.want {
+			t.Errorf("%s = %v, want %v", test.source, item.Value, test.want)
+		}
+	}
+}
+
+func TestExpressionRefs(t *testing.T) {
+	e, err := parseExpression("flow + {Area 1/Pump} * flow - rate(Area1.Level)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"Area 1/Pump", "Area1.Level", "flow"}
+	if len(e.refs) != len(want) {
+		t.Fatalf("refs %v, want %v", e.refs, want)
+	}
+	for i := range want {
+		if e.refs[i] != want[i] {
+			t.Errorf("refs %v, want %v", e.refs, want)
+		}
+	}
+}
+
+func TestExpressionParseErrors(t *testing.T) {
+	for _, source := range []string{
+		"",
+		"1 +",
+		"(1 + 2",
+		"1 + 2)",
+		"flow flow",
+		"1 $ 2",
+		"{Area 1",
+		"{}",
+		"sqrt(4)",
+		"min()",
+		"abs(1, 2)",
+		"if(1, 2)",
+		"max(1, 2",
+		"1..2",
+	} {
+		if _, err := parseExpression(source); err == nil {
+			t.Errorf("'%s' parsed without error", source)
+		}
+	}
+}
+
+func TestExpressionEvaluateErrors(t *testing.T) {
+	for _, source := range []string{"flow / zero", "flow % 0", "missing + 1", "text * 2", "max(flow, missing)"} {
+		e, err := parseExpression(source)
+		if err != nil {
+			t.Fatalf("%s: %s", source, err)
+		}
+
+		item, err := e.evaluate(exprItems(), exprTime)
+		if err == nil {
+			t.Errorf("%s = %v without error", source, item.Value)
+		}
+		if item.Quality != types.QualityBad {
+			t.Errorf("%s: failed evaluation has quality %#x, want bad", source, item.Quality)
+		}
+	}
+}
+
+func TestExpressionQuality(t *testing.T) {
+	items := exprItems()
+	items["flow"] = DataItem{Value: 1.0, Quality: 0x40, Timestamp: exprTime.Add(2 * time.Second)}
+	items["Area1.Level"] = DataItem{Value: 2, Quality: 0xC0, Timestamp: exprTime.Add(5 * time.Second)}
+	now := exprTime.Add(time.Minute)
+
+	tests := []struct {
+		source    string
+		quality   int
+		timestamp time.Time
+	}{
+		{"flow + Area1.Level", 0x40, exprTime.Add(5 * time.Second)}, // Worst quality, latest timestamp
+		{"Area1.Level * 2", 0xC0, exprTime.Add(5 * time.Second)},
+		{"1 + 2", 0xC0, now}, // No tags referenced
+	}
+
+	for _, test := range tests {
+		e, err := parseExpression(test.source)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		item, err := e.evaluate(items, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if item.Quality != test.quality || !item.Timestamp.Equal(test.timestamp) {
+			t.Errorf("%s: quality %#x at %s, want %#x at %s", test.source, item.Quality, item.Timestamp, test.quality, test.timestamp)
+		}
+	}
+}
+
+func TestExpressionRate(t *testing.T) {
+	e, err := parseExpression("rate(flow)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		seconds int
+		value   float64
+		rate    float64
+	}{
+		{0, 10, 0}, // No previous value
+		{2, 14, 2},
+		{4, 10, -2},
+		{4, 20, 0}, // No time passed
+	}
+
+	for _, step := range steps {
+		items := map[string]DataItem{"flow": {Value: step.value, Quality: 0xC0, Timestamp: exprTime}}
+		item, err := e.evaluate(items, exprTime.Add(time.Duration(step.seconds)*time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if item.Value != step.rate {
+			t.Errorf("rate of %f at %d s = %v, want %f", step.value, step.seconds, item.Value, step.rate)
+		}
+	}
+}
+
+func TestValidateExpression(t *testing.T) {
+	names := map[string]bool{"flow": false, "level": false, "total": true}
+	tests := []struct {
+		expression string
+		ok         bool
+	}{
+		{"flow + level", true},
+		{"flow + missing", false},
+		{"total * 2", false}, // Calculated tags can not refer to each other
+		{"self + 1", false},
+		{"flow +", false},
+	}
+
+	for _, test := range tests {
+		tag := &types.OPCTag{Name: "self", Expression: test.expression}
+		if err := ValidateExpression(tag, names); (err == nil) != test.ok {
+			t.Errorf("%s: err %v", test.expression, err)
+		}
+	}
+}
@@ -10,10 +10,10 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
-	"net"
 	"os"
 	"path"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -31,26 +31,40 @@ type context struct {
 	donedir       string
 	modulus       int
 	msdelay       int
+	timeout       time.Duration // Time to wait for room in a proxy's send queue
+}
+
+type fileRequest struct {
+	info  *types.FileInfo
+	proxy *types.DiodeProxy
 }
 
 var proxy *types.DiodeProxy
+var transfer *context
+var requests []fileRequest
+var requestsMutex sync.Mutex
 
 func InitFileTransfer(gctx types.Context) error {
 	m, _ := strconv.Atoi(InitSetting("filetransfer.modulus", "20", "Number of packets to send before quick pause").Value)
 	d, _ := strconv.Atoi(InitSetting("filetransfer.msdelay", "20", "Number of milliseconds to pause before start sending again").Value)
+	t, _ := strconv.Atoi(InitSetting("filetransfer.queuetimeout", "10", "Seconds to wait for room in a proxy's send queue before a file transfer fails").Value)
 
 	proxy = FirstProxy()
 	if proxy != nil {
-		ctx := initContext(m, d, gctx)
-		go monitorFilesystem(ctx)
+		transfer = initContext(m, d, t, gctx)
+		go monitorFilesystem(transfer)
 		return nil
 	}
 
 	return logger.Error("file transfer disabled", "No proxy defined. At least one proxy must be defined")
 }
 
-func initContext(m int, d int, gctx types.Context) *context {
-	ctx := &context{basedir: path.Join(gctx.Wdir, "outgoing"), newdir: "new", processingdir: "processing", donedir: "done", modulus: m, msdelay: d}
+func initContext(m int, d int, t int, gctx types.Context) *context {
+	if t < 1 {
+		t = 10
+	}
+
+	ctx := &context{basedir: path.Join(gctx.Wdir, "outgoing"), newdir: "new", processingdir: "processing", donedir: "done", modulus: m, msdelay: d, timeout: time.Duration(t) * time.Second}
 	os.MkdirAll(path.Join(ctx.basedir, ctx.newdir), 0755)
 	os.MkdirAll(path.Join(ctx.basedir, ctx.processingdir), 0755)
 	os.MkdirAll(path.Join(ctx.basedir, ctx.donedir), 0755)
@@ -63,6 +77,27 @@ func monitorFilesystem(ctx *context) {
 	for {
 		<-ticker.C
 		processDirectory(ctx, ".")
+		processRequests(ctx)
+	}
+}
+
+// queueFile requests a file already in the processing area to be sent through a
+// specific proxy
+func queueFile(info *types.FileInfo, target *types.DiodeProxy) {
+	requestsMutex.Lock()
+	requests = append(requests, fileRequest{info: info, proxy: target})
+	requestsMutex.Unlock()
+}
+
+func processRequests(ctx *context) {
+	requestsMutex.Lock()
+	pending := requests
+	requests = nil
+	requestsMutex.Unlock()
+
+	for _, r := range pending {
+		logger.NotifySubscribers("filetransfer.request", r.info)
+		sendFile(ctx, r.info, proxyRoute(r.proxy)) // Do it sequentially to minimize packet loss
 	}
 }
 
@@ -80,7 +115,7 @@ func processDirectory(ctx *context, dirname string) {
 				// log.Printf("Requested processing of file: %s (%s)", filename, movename)
 				info := &types.FileInfo{Name: fi.Name(), Path: dirname, Size: int(fi.Size()), Date: fi.ModTime()}
 				logger.NotifySubscribers("filetransfer.request", info)
-				sendFile(ctx, info) // Do it sequentially to minimize packet loss
+				sendFile(ctx, info, proxyRoute(proxy)) // Do it sequentially to minimize packet loss
 			} else {
 				// log.Printf("Failed to move file to processing area: %s, error %s", filename, err.Error())
 			}
@@ -90,7 +125,7 @@ func processDirectory(ctx *context, dirname string) {
 	}
 }
 
-func sendFile(ctx *context, info *types.FileInfo) error {
+func sendFile(ctx *context, info *types.FileInfo, route []*types.DiodeProxy) error {
 	dir := info.Path
 	name := info.Name
 	filename := path.Join(ctx.basedir, ctx.processingdir, dir, name)
@@ -111,11 +146,8 @@ func sendFile(ctx *context, info *types.FileInfo) error {
 		return fmt.Errorf("empty file")
 	}
 
-	target := fmt.Sprintf("%s:%d", proxy.EndpointIP, proxy.FilePort)
-	c, err := net.Dial("udp", target)
-	if err != nil {
-		logger.Error("Filetransfer", "Failed to dial %s", target)
-		return err
+	if len(route) == 0 {
+		return logger.Error("Filetransfer", "No proxy to send %s through", filename)
 	}
 
 	hash := calcHash(filename)
@@ -132,7 +164,9 @@ func sendFile(ctx *context, info *types.FileInfo) error {
 	n := 0
 	binhead := []byte(header)
 	copy(content, binhead)
-	c.Write(content)
+	if err = sendPacket(ctx, route, content); err != nil {
+		return failFile(file, info, err)
+	}
 
 	total := 0
 	counter := uint32(0)
@@ -141,8 +175,10 @@ func sendFile(ctx *context, info *types.FileInfo) error {
 		n, err = file.Read(content[8:])
 		binary.LittleEndian.PutUint32(content, counter)
 		binary.LittleEndian.PutUint32(content[4:], uint32(n))
-		sn, _ := c.Write(content) // Always write full buffer
-		total += sn
+		if serr := sendPacket(ctx, route, content); serr != nil { // Always write full buffer
+			return failFile(file, info, serr)
+		}
+		total += len(content)
 		counter++
 
 		if counter%1000 == 0 {
@@ -160,9 +196,10 @@ func sendFile(ctx *context, info *types.FileInfo) error {
 	content = make([]byte, 1200)
 	binfoot := []byte(footer)
 	copy(content, binfoot)
-	c.Write(content)
+	if err = sendPacket(ctx, route, content); err != nil {
+		return failFile(file, info, err)
+	}
 
-	c.Close()
 	file.Close()
 
 	todir := path.Join(ctx.basedir, ctx.donedir, dir)
@@ -182,6 +219,28 @@ func sendFile(ctx *context, info *types.FileInfo) error {
 	return err
 }
 
+// sendPacket sends a copy of the packet through every proxy in the route, since the
+// content buffer is reused while the proxies are still writing. A full send queue
+// holds up the transfer until the proxy catches up, and fails it if the proxy does
+// not within the queue timeout
+func sendPacket(ctx *context, route []*types.DiodeProxy, content []byte) error {
+	packet := make([]byte, len(content))
+	copy(packet, content)
+	if count := sendWait(route, channelFile, packet, ctx.timeout); count < len(route) {
+		return fmt.Errorf("packet dropped by %d of %d proxies", len(route)-count, len(route))
+	}
+
+	return nil
+}
+
+// failFile closes a file whose transfer failed and leaves it in the processing area,
+// from where it can be requested again
+func failFile(file *os.File, info *types.FileInfo, err error) error {
+	file.Close()
+	logger.NotifySubscribers("filetransfer.failed", info)
+	return logger.Error("File transfer failed", "File %s in %s was not completely sent and is left in the processing area, error: %s", info.Name, info.Path, err.Error())
+}
+
 func calcHash(filename string) hash.Hash {
 	f, err := os.Open(filename)
 	if err != nil {
@@ -2,44 +2,32 @@ package engine
 
 import (
 	"dd-opcda/db"
-	"dd-opcda/logger"
 	"dd-opcda/types"
 	"encoding/json"
 	"fmt"
-	"net"
-	"sync"
+	"strconv"
 	"time"
 
-	"github.com/cyops-se/opc"
+	"gorm.io/gorm"
 )
 
-var opcmutex sync.Mutex // Issue #3, no time to find out where thread insafety is (looks like it's in or below oleutil)
-
-func metaSender(diodeProxy *types.DiodeProxy) {
+// metaSender periodically sends the ID and name of the tags in each group through
+// every proxy the group sends its data through
+func metaSender() {
 	defer handlePanic("metaSender")
-	address := fmt.Sprintf("%s:%d", diodeProxy.EndpointIP, diodeProxy.MetaPort)
-
-	logger.Log("trace", "Setting up outgoing META", address)
-
-	con, err := net.Dial("udp", address)
-	if con == nil {
-		logger.Error("Groups engine", "UDP emitter to IP: %s could not be opened, error: %s", address, err.Error())
-		return
-	}
-
 	timer := time.NewTicker(10 * time.Minute)
 	for {
-		tags, _ := GetTagInfos()
-		batchsize := 100
-		for i := 0; i < len(tags); i += batchsize {
-			if i+batchsize > len(tags) {
-				batchsize = len(tags) - i
-			}
-			msg, _ := json.Marshal(tags[i : i+batchsize])
-			if _, err := con.Write(msg); err != nil {
-				logger.Error("Groups engine", "Failed to send meta data: %s", err.Error())
-			} else {
-				// log.Println("Sending meta data ... ", len(tags), n)
+		groups, _ := GetGroups()
+		for _, group := range groups {
+			route := groupRoute(group)
+			tags, _ := GetGroupTagInfos(group.ID)
+			batchsize := 100
+			for i := 0; i < len(tags); i += batchsize {
+				if i+batchsize > len(tags) {
+					batchsize = len(tags) - i
+				}
+				msg, _ := json.Marshal(tags[i : i+batchsize])
+				send(route, channelMeta, msg)
 			}
 		}
 
@@ -47,140 +35,78 @@ func metaSender(diodeProxy *types.DiodeProxy) {
 	}
 }
 
-func read(client *opc.Connection) map[string]opc.Item {
-	defer handlePanic("read")
-	opcmutex.Lock()
-	defer opcmutex.Unlock()
-	return (*client).Read()
-}
-
-func groupDataCollector(group *types.OPCGroup, tags []*types.OPCTag) {
-	defer handlePanic("groupDataCollector")
-	timer := time.NewTicker(time.Duration(group.Interval) * time.Second)
-
-	client, err := opc.NewConnectionWithoutTags(group.ProgID, // ProgId
-		[]string{"localhost"}, //  OPC servers nodes
-	)
-
-	if err != nil {
-		logger.Log("error", "Failed to connect OPC DA server", fmt.Sprintf("Group: %s, progid: %s, err: %s", group.Name, group.ProgID, err.Error()))
-		logger.NotifySubscribers("group.failed", group)
-		return
-	}
-
-	defer client.Close()
-
-	// Adding items
-	for _, tag := range tags {
-		if err := client.AddSingle(tag.Name); err != nil {
-			logger.Log("warning", "Unable to collect tag", fmt.Sprintf("%s, group: %s, progid: %s", tag.Name, group.Name, group.ProgID))
-		}
+// groupSourceType returns the data source type of a group. Groups without an explicit
+// type use the type of the discovered server with the same program ID
+func groupSourceType(group *types.OPCGroup) string {
+	if group.SourceType != "" {
+		return group.SourceType
 	}
 
-	if len(client.Tags()) == 0 {
-		logger.Log("error", "No tags to collect", fmt.Sprintf("Group: %s, progid: %s", group.Name, group.ProgID))
-		logger.NotifySubscribers("group.failed", group)
-		return
+	if server, err := GetServerByProgID(group.ProgID); err == nil {
+		return server.Type
 	}
 
-	logger.Log("trace", "Collecting tags", fmt.Sprintf("%d tags from group: %s", len(client.Tags()), group.Name))
-
-	items := read(&client) // This is only to get the number of items
-	msg := &types.DataMessage{Version: 2, Group: group.Name, Interval: group.Interval}
-	msg.Count = 10
-	msg.Points = make([]types.DataPoint, msg.Count)
+	return DataSourceOPCDA
+}
 
-	// Initiate group running state
+func InitGroups() {
+	defer handlePanic("InitGroups")
+	InitSetting("tagpathdelimiter", ".", "Delimiter in OPC DA tag paths. Differs between OPC DA servers")
+	InitSetting("group.mininterval", "10", "Shortest sampling interval in milliseconds allowed for a group")
 
-	if len(client.Tags()) != len(tags) {
-		group.Status = types.GroupStatusRunningWithWarning
-		logger.NotifySubscribers("group.warning", group)
-	} else {
-		group.Status = types.GroupStatusRunning
-		logger.NotifySubscribers("group.started", group)
+	// Group intervals used to be in seconds, convert them once to milliseconds
+	if _, err := GetSetting("group.intervalunit"); err != nil {
+		db.DB.Model(&types.OPCGroup{}).Where("interval > 0").Update("interval", gorm.Expr("interval * 1000"))
+		InitSetting("group.intervalunit", "ms", "Unit of group sampling intervals (do not change)")
 	}
 
-	group.Counter = 0
-	db.DB.Save(group)
-
-	var i, b int // golang always initialize to 0
-	for {
-		if g, _ := GetGroup(group.ID); g != nil && g.Status == types.GroupStatusNotRunning {
-			logger.Log("info", "OPC group stopped", fmt.Sprintf("Group interval timer STOPPED, group: %s", group.Name))
-			logger.NotifySubscribers("group.stopped", group)
-			break
-		}
-
-		items = read(&client)
-
-		for k, v := range items {
-			msg.Points[b].Time = v.Timestamp
-			msg.Points[b].Name = k
-			msg.Points[b].Value = v.Value
-			msg.Points[b].Quality = int(v.Quality)
-
-			// Send batch when msg.Points is full (keep it small to avoid fragmentation)
-			if b == len(msg.Points)-1 {
-				data, _ := json.Marshal(msg)
-				if proxy := FirstProxy(); proxy != nil {
-					proxy.DataChan <- data
-					b = 0
-					msg.Sequence++
-					logger.NotifySubscribers("data.message", string(data))
-					cacheMessage(msg)
-				}
-			} else {
-				b++
-			}
-			i++
-		}
-
-		group.LastRun = time.Now()
-		group.Counter = group.Counter + uint(len(items))
-
-		db.DB.Model(&group).Updates(types.OPCGroup{LastRun: group.LastRun, Counter: group.Counter})
-		logger.NotifySubscribers("data.group", group)
-
-		<-timer.C
+	// Proxies must be ready before groups start sending
+	var proxies []*types.DiodeProxy
+	db.DB.Table("diode_proxies").Order("id").Find(&proxies)
+	for _, proxy := range proxies {
+		initProxy(proxy)
 	}
-}
+	loadSigningKeys()
+	go signingKeyLoader()
 
-func InitGroups() {
-	defer handlePanic("InitGroups")
-	InitSetting("tagpathdelimiter", ".", "Delimiter in OPC DA tag paths. Differs between OPC DA servers")
+	go metaSender()
 
 	items, _ := GetGroups()
 	for _, item := range items {
 		item.Status = types.GroupStatusNotRunning
-		db.DB.Save(item)
+		db.DB.Model(item).Update("status", item.Status)
 
 		if item.RunAtStart {
 			Start(item)
 		}
 	}
 
-	var proxies []*types.DiodeProxy
-	db.DB.Table("diode_proxies").Order("id").Find(&proxies)
-	for _, proxy := range proxies {
-		initProxy(proxy)
-		// go metaSender(proxy)
-	}
+	// Scheduled groups are started and stopped as their windows open and close
+	go groupScheduler()
 }
 
 func GetGroups() ([]*types.OPCGroup, error) {
 	defer handlePanic("GetGroups")
 	var items []*types.OPCGroup
-	db.DB.Table("opc_groups").Order("id").Preload("DiodeProxy").Find(&items)
+	db.DB.Table("opc_groups").Order("id").Preload("DiodeProxy").Preload("RedundantProxies").Find(&items)
+	for _, item := range items {
+		item.State = GroupState(item.ID)
+		fillSchedule(item)
+	}
+
 	return items, nil
 }
 
 func GetGroup(id uint) (*types.OPCGroup, error) {
 	defer handlePanic("GetGroup")
 	var item types.OPCGroup
-	if err := db.DB.Table("opc_groups").Preload("DiodeProxy").Take(&item, id).Error; err != nil {
+	if err := db.DB.Table("opc_groups").Preload("DiodeProxy").Preload("RedundantProxies").Take(&item, id).Error; err != nil {
 		return nil, err
 	}
 
+	item.State = GroupState(item.ID)
+	fillSchedule(&item)
+
 	return &item, nil
 }
 
@@ -204,42 +130,44 @@ func GetGroupTags(id uint) ([]*types.OPCTag, error) {
 	return items, nil
 }
 
-func Start(group *types.OPCGroup) (err error) {
-	defer handlePanic("Start")
-	// Make sure the group is not already running
-	if group.Status != types.GroupStatusNotRunning {
-		err = fmt.Errorf("Group already running, group: %s (id: %d)", group.Name, group.ID)
-		logger.Log("error", "OPC collection start failed", err.Error())
-		return
+// ValidateGroup checks the sampling settings of a group
+func ValidateGroup(group *types.OPCGroup) error {
+	mininterval, _ := strconv.Atoi(InitSetting("group.mininterval", "10", "Shortest sampling interval in milliseconds allowed for a group").Value)
+	if group.Interval < mininterval || group.Interval < 1 {
+		return fmt.Errorf("group %s: sampling interval must be at least %d ms", group.Name, mininterval)
 	}
 
-	var tags []*types.OPCTag
-	db.DB.Table("opc_tags").Find(&tags, "group_id = ?", group.ID)
-	if len(tags) <= 0 {
-		err = fmt.Errorf("Group does not have any tags defined, group: %s (id: %d)", group.Name, group.ID)
-		logger.Log("error", "OPC collection start failed", err.Error())
-		return
+	if group.Mode != types.GroupModePolling && group.Mode != types.GroupModeSubscription {
+		return fmt.Errorf("group %s: unknown collection mode %d", group.Name, group.Mode)
 	}
 
-	go groupDataCollector(group, tags)
+	if group.UpdateRate < 0 || group.MaxSilence < 0 {
+		return fmt.Errorf("group %s: update rate and max silence must not be negative", group.Name)
+	}
 
-	return
-}
+	if group.PercentDeadband < 0 || group.PercentDeadband > 100 {
+		return fmt.Errorf("group %s: percent deadband must be between 0 and 100", group.Name)
+	}
+
+	if group.QualityPolicy < types.QualityPolicyAll || group.QualityPolicy > types.QualityPolicyTransitions {
+		return fmt.Errorf("group %s: unknown quality policy %d", group.Name, group.QualityPolicy)
+	}
 
-func Stop(group *types.OPCGroup) (err error) {
-	defer handlePanic("Stop")
-	// Make sure the group is running
-	if group.Status != types.GroupStatusRunning && group.Status != types.GroupStatusRunningWithWarning {
-		err = fmt.Errorf("Group not running, group: %s (id: %d)", group.Name, group.ID)
-		logger.Log("error", "OPC collection stop failed", err.Error())
-		return
+	if group.TimestampSource < types.TimestampServer || group.TimestampSource > types.TimestampBoth {
+		return fmt.Errorf("group %s: unknown timestamp source %d", group.Name, group.TimestampSource)
 	}
 
-	// Stop collection go routine (unsafe)
-	group.Status = types.GroupStatusNotRunning
-	db.DB.Save(group)
+	if group.MaxClockSkew < 0 || group.FrozenAfter < 0 || group.StaleAfter < 0 {
+		return fmt.Errorf("group %s: max clock skew and frozen and stale thresholds must not be negative", group.Name)
+	}
 
-	return
+	if group.Schedule != "" {
+		if _, err := parseSchedule(group.Schedule); err != nil {
+			return fmt.Errorf("group %s: invalid schedule: %s", group.Name, err.Error())
+		}
+	}
+
+	return nil
 }
 
 func GetTagNames() ([]string, error) {
@@ -264,3 +192,13 @@ func GetTagInfos() (items []*types.TagsInfos, err error) {
 
 	return items, nil
 }
+
+// GetGroupTagInfos returns the ID and name of the tags in a group
+func GetGroupTagInfos(id uint) (items []*types.TagsInfos, err error) {
+	defer handlePanic("GetGroupTagInfos")
+	if err = db.DB.Table("opc_tags").Where("deleted_at is null and group_id = ?", id).Find(&items).Error; err != nil {
+		return nil, err
+	}
+
+	return items, nil
+}
@@ -0,0 +1,31 @@
+package engine
+
+import "dd-opcda/types"
+
+// applyQualityPolicy returns the item to send under the group's quality policy, or
+// false if it should not be sent. Only values of bad quality are affected
+func (s *tagState) applyQualityPolicy(policy int, item DataItem) (DataItem, bool) {
+	if !item.Bad() {
+		if item.Quality&types.QualityStatusMask == types.QualityGood {
+			s.good = true
+			s.goodValue = item.Value
+		}
+		return item, true
+	}
+
+	switch policy {
+	case types.QualityPolicyDropBad:
+		return item, false
+	case types.QualityPolicyLastGood:
+		item.Value = nil
+		if s.good {
+			item.Value = s.goodValue
+		}
+	case types.QualityPolicyTransitions:
+		if s.sent && s.sentQuality == item.Quality {
+			return item, false
+		}
+	}
+
+	return item, true
+}
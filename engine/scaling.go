@@ -0,0 +1,77 @@
+package engine
+
+import (
+	"dd-opcda/types"
+	"fmt"
+	"math"
+)
+
+// validateScaling checks the engineering unit transform of a tag
+func validateScaling(tag *types.OPCTag) error {
+	switch tag.ScaleMode {
+	case types.ScaleNone:
+	case types.ScaleLinear:
+		if tag.Scale == 0 {
+			return fmt.Errorf("tag %s: linear scaling requires a non-zero scale", tag.Name)
+		}
+	case types.ScaleRange:
+		if tag.RawHigh == tag.RawLow {
+			return fmt.Errorf("tag %s: range scaling requires a raw range (rawhigh != rawlow)", tag.Name)
+		}
+		if tag.EUHigh <= tag.EULow {
+			return fmt.Errorf("tag %s: range scaling requires an engineering range (euhigh > eulow)", tag.Name)
+		}
+	default:
+		return fmt.Errorf("tag %s: unknown scale mode %d", tag.Name, tag.ScaleMode)
+	}
+
+	if tag.Clamp && tag.EUHigh <= tag.EULow {
+		return fmt.Errorf("tag %s: clamping requires an engineering range (euhigh > eulow)", tag.Name)
+	}
+
+	return nil
+}
+
+// scale converts a raw numeric value to engineering units, either linearly with the
+// tag's scale and offset or by mapping the raw range to the engineering range, and
+// optionally clamps it to the engineering range. Other values are returned as is
+func scale(tag *types.OPCTag, item DataItem) DataItem {
+	if tag == nil || (tag.ScaleMode == types.ScaleNone && !tag.Clamp) {
+		return item
+	}
+
+	value, ok := toFloat(item.Value)
+	if !ok {
+		return item
+	}
+
+	switch tag.ScaleMode {
+	case types.ScaleLinear:
+		value = value*tag.Scale + tag.Offset
+	case types.ScaleRange:
+		value = tag.EULow + (value-tag.RawLow)*(tag.EUHigh-tag.EULow)/(tag.RawHigh-tag.RawLow)
+	}
+
+	if tag.Clamp && tag.EUHigh > tag.EULow {
+		value = math.Max(tag.EULow, math.Min(tag.EUHigh, value))
+	}
+
+	item.Value = value
+	return item
+}
+
+// rawRange returns the range of the raw values of a tag as read from the data source,
+// which is used by subscription deadbands that work before scaling
+func rawRange(tag *types.OPCTag) (float64, float64, bool) {
+	switch tag.ScaleMode {
+	case types.ScaleNone:
+		return tag.EULow, tag.EUHigh, tag.EUHigh > tag.EULow
+	case types.ScaleLinear:
+		low, high := (tag.EULow-tag.Offset)/tag.Scale, (tag.EUHigh-tag.Offset)/tag.Scale
+		return math.Min(low, high), math.Max(low, high), tag.EUHigh > tag.EULow
+	case types.ScaleRange:
+		return math.Min(tag.RawLow, tag.RawHigh), math.Max(tag.RawLow, tag.RawHigh), true
+	}
+
+	return 0, 0, false
+}
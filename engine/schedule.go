@@ -0,0 +1,307 @@
+package engine
+
+import (
+	"dd-opcda/db"
+	"dd-opcda/logger"
+	"dd-opcda/types"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A group schedule is a list of weekly windows, in local time, separated by ';':
+//
+//	mon-fri 06:00-18:00; sat 08:00-12:00; sun,wed 22:00-02:00; * 12:00-13:00
+//
+// Days are mon, tue, wed, thu, fri, sat and sun, ranges of days, comma separated days,
+// or '*' for every day. A window that ends before it starts ends the next day, and
+// 24:00 is the end of the day. The group runs while any window is open.
+
+var scheduleDays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+type schedule struct {
+	windows []scheduleWindow
+}
+
+type scheduleWindow struct {
+	days  [7]bool // Indexed by time.Weekday
+	start int     // Minutes from midnight
+	end   int
+}
+
+// scheduled remembers whether each scheduled group's windows were open at the last
+// check, so groups are only started and stopped when a window opens or closes
+var scheduled = map[uint]bool{}
+var scheduledMutex sync.Mutex
+
+// Delays before a failed scheduled start or stop is tried again
+const (
+	scheduleRetryMin = 10 * time.Second
+	scheduleRetryMax = time.Hour
+)
+
+// scheduleFailure is a failed scheduled start or stop of a group. It is tried again
+// after a delay that doubles with every failure, or at the next check if the group
+// has been changed since
+type scheduleFailure struct {
+	retry   *backoff
+	next    time.Time
+	updated time.Time // UpdatedAt of the group when it failed
+}
+
+var scheduleFailures = map[uint]*scheduleFailure{} // Guarded by scheduledMutex
+
+func parseSchedule(text string) (*schedule, error) {
+	s := &schedule{}
+	for _, field := range strings.Split(text, ";") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+
+		parts := strings.Fields(field)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("window '%s' is not '<days> <hh:mm>-<hh:mm>'", field)
+		}
+
+		var w scheduleWindow
+		if err := w.parseDays(strings.ToLower(parts[0])); err != nil {
+			return nil, err
+		}
+
+		times := strings.Split(parts[1], "-")
+		if len(times) != 2 {
+			return nil, fmt.Errorf("window '%s' does not have a time range", field)
+		}
+
+		var err error
+		if w.start, err = parseClock(times[0]); err != nil {
+			return nil, err
+		}
+		if w.end, err = parseClock(times[1]); err != nil {
+			return nil, err
+		}
+		if w.start == w.end {
+			return nil, fmt.Errorf("window '%s' is empty", field)
+		}
+
+		s.windows = append(s.windows, w)
+	}
+
+	if len(s.windows) == 0 {
+		return nil, fmt.Errorf("schedule has no windows")
+	}
+
+	return s, nil
+}
+
+func (w *scheduleWindow) parseDays(text string) error {
+	if text == "*" {
+		for i := range w.days {
+			w.days[i] = true
+		}
+		return nil
+	}
+
+	for _, item := range strings.Split(text, ",") {
+		bounds := strings.Split(item, "-")
+		if len(bounds) > 2 {
+			return fmt.Errorf("invalid days '%s'", item)
+		}
+
+		first, err := parseDay(bounds[0])
+		if err != nil {
+			return err
+		}
+
+		last := first
+		if len(bounds) == 2 {
+			if last, err = parseDay(bounds[1]); err != nil {
+				return err
+			}
+		}
+
+		for day := first; ; day = (day + 1) % 7 {
+			w.days[day] = true
+			if day == last {
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+func parseDay(text string) (int, error) {
+	for i, day := range scheduleDays {
+		if text == day {
+			return i, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown day '%s'", text)
+}
+
+func parseClock(text string) (int, error) {
+	parts := strings.Split(text, ":")
+	if len(parts) == 2 {
+		hours, herr := strconv.Atoi(parts[0])
+		minutes, merr := strconv.Atoi(parts[1])
+		if herr == nil && merr == nil && hours >= 0 && minutes >= 0 && minutes < 60 && (hours < 24 || (hours == 24 && minutes == 0)) {
+			return hours*60 + minutes, nil
+		}
+	}
+
+	return 0, fmt.Errorf("invalid time '%s', expected hh:mm", text)
+}
+
+// active returns true if any window is open at t
+func (s *schedule) active(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	today := t.Weekday()
+	yesterday := (today + 6) % 7
+
+	for _, w := range s.windows {
+		if w.start < w.end {
+			if w.days[today] && minute >= w.start && minute < w.end {
+				return true
+			}
+		} else if (w.days[today] && minute >= w.start) || (w.days[yesterday] && minute < w.end) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// change returns the next time after t a window opens or closes, found among the
+// starts and ends of the windows from the day before t until a week after it. Times
+// where one window closes as another opens are not changes
+func (s *schedule) change(t time.Time) time.Time {
+	var times []time.Time
+	year, month, day := t.Date()
+	for offset := -1; offset <= 7; offset++ {
+		date := time.Date(year, month, day+offset, 0, 0, 0, 0, t.Location())
+		for _, w := range s.windows {
+			if !w.days[date.Weekday()] {
+				continue
+			}
+
+			end := w.end
+			if w.end < w.start {
+				end += 24 * 60
+			}
+			times = append(times, clockTime(year, month, day+offset, w.start, t.Location()), clockTime(year, month, day+offset, end, t.Location()))
+		}
+	}
+
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+
+	active := s.active(t)
+	for _, next := range times {
+		if next.After(t) && s.active(next) != active {
+			return next
+		}
+	}
+
+	return time.Time{}
+}
+
+// clockTime returns the local time minutes after the midnight that starts the day
+func clockTime(year int, month time.Month, day int, minutes int, loc *time.Location) time.Time {
+	return time.Date(year, month, day, minutes/60, minutes%60, 0, 0, loc)
+}
+
+// fillSchedule sets whether the group's schedule is open and when it next changes
+func fillSchedule(group *types.OPCGroup) {
+	group.ScheduleActive = false
+	group.ScheduleChange = nil
+	if group.Schedule == "" {
+		return
+	}
+
+	s, err := parseSchedule(group.Schedule)
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	group.ScheduleActive = s.active(now)
+	if change := s.change(now); !change.IsZero() {
+		group.ScheduleChange = &change
+	}
+}
+
+// groupScheduler starts groups when a window of their schedule opens and stops them
+// when it closes
+func groupScheduler() {
+	defer handlePanic("groupScheduler")
+	ticker := time.NewTicker(10 * time.Second)
+	for {
+		groups, _ := GetGroups()
+		for _, group := range groups {
+			scheduleGroup(group)
+		}
+
+		<-ticker.C
+	}
+}
+
+func scheduleGroup(group *types.OPCGroup) {
+	scheduledMutex.Lock()
+	defer scheduledMutex.Unlock()
+
+	if group.Schedule == "" {
+		delete(scheduled, group.ID)
+		delete(scheduleFailures, group.ID)
+		return
+	}
+
+	active := group.ScheduleActive
+	if last, ok := scheduled[group.ID]; ok && last == active {
+		delete(scheduleFailures, group.ID)
+		return
+	}
+
+	failure, failed := scheduleFailures[group.ID]
+	if failed && failure.updated.Equal(group.UpdatedAt) && time.Now().Before(failure.next) {
+		return
+	}
+
+	// The window is only recorded once the group is in its scheduled state, so a failed
+	// start or stop is tried again later
+	var err error
+	action := "start"
+	running := group.State != types.GroupStateStopped
+	if active && !running {
+		logger.Log("info", "Scheduled group start", fmt.Sprintf("Group: %s, schedule: %s", group.Name, group.Schedule))
+		logger.NotifySubscribers("group.scheduled", group)
+		err = Start(group)
+	} else if !active && running {
+		action = "stop"
+		logger.Log("info", "Scheduled group stop", fmt.Sprintf("Group: %s, schedule: %s", group.Name, group.Schedule))
+		logger.NotifySubscribers("group.scheduled", group)
+		err = Stop(group)
+	}
+
+	if err == nil {
+		scheduled[group.ID] = active
+		delete(scheduleFailures, group.ID)
+		return
+	}
+
+	if !failed || !failure.updated.Equal(group.UpdatedAt) {
+		failure = &scheduleFailure{retry: &backoff{min: scheduleRetryMin, max: scheduleRetryMax}, updated: group.UpdatedAt}
+		scheduleFailures[group.ID] = failure
+	}
+
+	delay := failure.retry.next()
+	failure.next = time.Now().Add(delay)
+	logger.Log("error", "Scheduled group "+action+" failed", fmt.Sprintf("Group: %s, trying again in %s or when the group is changed, err: %s", group.Name, delay.String(), err.Error()))
+
+	// Not an update of the group, which would count as a change
+	group.LastError = err.Error()
+	db.DB.Model(group).UpdateColumn("last_error", group.LastError)
+}
@@ -0,0 +1,166 @@
+package engine
+
+import (
+	"dd-opcda/db"
+	"dd-opcda/types"
+	"testing"
+	"time"
+)
+
+func TestScheduleFailureBackoff(t *testing.T) {
+	// A group without tags can not be started
+	group := &types.OPCGroup{Name: t.Name(), ProgID: simulatorProgID, SourceType: DataSourceSimulator, Interval: 1000, Schedule: "* 00:00-24:00"}
+	db.DB.Create(group)
+	group.State = types.GroupStateStopped
+	group.ScheduleActive = true
+	defer func() {
+		scheduledMutex.Lock()
+		delete(scheduled, group.ID)
+		delete(scheduleFailures, group.ID)
+		scheduledMutex.Unlock()
+	}()
+
+	failure := func() scheduleFailure {
+		scheduledMutex.Lock()
+		defer scheduledMutex.Unlock()
+		if f, ok := scheduleFailures[group.ID]; ok {
+			return *f
+		}
+		t.Fatal("failed start not recorded")
+		return scheduleFailure{}
+	}
+
+	scheduleGroup(group)
+	first := failure()
+	if first.retry.delay != scheduleRetryMin {
+		t.Errorf("first retry in %s, want %s", first.retry.delay, scheduleRetryMin)
+	}
+	if group.LastError == "" {
+		t.Errorf("failed start not recorded on the group")
+	}
+
+	// Checks before the retry time leave the group alone
+	scheduleGroup(group)
+	if again := failure(); !again.next.Equal(first.next) {
+		t.Errorf("start tried again before the retry time")
+	}
+
+	// The delay doubles with each failure
+	scheduledMutex.Lock()
+	scheduleFailures[group.ID].next = time.Now()
+	scheduledMutex.Unlock()
+	scheduleGroup(group)
+	if second := failure(); second.retry.delay != 2*scheduleRetryMin {
+		t.Errorf("second retry in %s, want %s", second.retry.delay, 2*scheduleRetryMin)
+	}
+
+	// A changed group is tried at the next check, starting over from the min delay
+	group.UpdatedAt = group.UpdatedAt.Add(time.Second)
+	scheduleGroup(group)
+	if changed := failure(); !changed.updated.Equal(group.UpdatedAt) || changed.retry.delay != scheduleRetryMin {
+		t.Errorf("changed group not tried again, retry in %s", changed.retry.delay)
+	}
+}
+
+// scheduleTime returns a time in the week of Sunday 18 October 2026
+func scheduleTime(day int, hour int, minute int) time.Time {
+	return time.Date(2026, 10, day, hour, minute, 0, 0, time.UTC)
+}
+
+func TestParseSchedule(t *testing.T) {
+	tests := []struct {
+		text string
+		ok   bool
+	}{
+		{"mon-fri 06:00-18:00", true},
+		{"MON,wed 00:00-24:00; * 12:00-13:00;", true},
+		{"fri-mon 22:00-02:00", true},
+		{"", false},
+		{" ; ", false},
+		{"mon", false},
+		{"mon 06:00", false},
+		{"mon 06:00-07:00-08:00", false},
+		{"xyz 06:00-07:00", false},
+		{"mon-tue-wed 06:00-07:00", false},
+		{"mon 06:60-07:00", false},
+		{"mon 24:01-07:00", false},
+		{"mon 6-7", false},
+		{"mon 06:00-06:00", false},
+	}
+
+	for _, test := range tests {
+		if _, err := parseSchedule(test.text); (err == nil) != test.ok {
+			t.Errorf("'%s': err %v", test.text, err)
+		}
+	}
+}
+
+func TestScheduleActive(t *testing.T) {
+	s, err := parseSchedule("mon-fri 06:00-18:00; sat 08:00-12:00; sun 22:00-02:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		t      time.Time
+		active bool
+	}{
+		{"monday before", scheduleTime(19, 5, 59), false},
+		{"monday start", scheduleTime(19, 6, 0), true},
+		{"monday last minute", scheduleTime(19, 17, 59), true},
+		{"monday end", scheduleTime(19, 18, 0), false},
+		{"friday", scheduleTime(23, 12, 0), true},
+		{"saturday", scheduleTime(24, 8, 0), true},
+		{"saturday end", scheduleTime(24, 12, 0), false},
+		{"sunday day", scheduleTime(18, 12, 0), false},
+		{"sunday night", scheduleTime(18, 22, 30), true},
+		{"after sunday midnight", scheduleTime(19, 1, 0), true},
+		{"after monday midnight", scheduleTime(20, 1, 0), false},
+	}
+
+	for _, test := range tests {
+		if got := s.active(test.t); got != test.active {
+			t.Errorf("%s: active %v, want %v", test.name, got, test.active)
+		}
+	}
+
+	// Day ranges wrap around the week
+	s, err = parseSchedule("fri-mon 00:00-24:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for day, active := range map[int]bool{18: true, 19: true, 20: false, 22: false, 23: true, 24: true} {
+		if got := s.active(scheduleTime(day, 12, 0)); got != active {
+			t.Errorf("fri-mon on the %dth: active %v, want %v", day, got, active)
+		}
+	}
+}
+
+func TestScheduleChange(t *testing.T) {
+	tests := []struct {
+		text   string
+		t      time.Time
+		change time.Time
+	}{
+		{"mon-fri 06:00-18:00", scheduleTime(19, 5, 0), scheduleTime(19, 6, 0)},
+		{"mon-fri 06:00-18:00", scheduleTime(19, 12, 0), scheduleTime(19, 18, 0)},
+		{"mon-fri 06:00-18:00", scheduleTime(19, 18, 0), scheduleTime(20, 6, 0)},
+		{"mon-fri 06:00-18:00; sat 08:00-12:00", scheduleTime(23, 20, 0), scheduleTime(24, 8, 0)},
+		{"mon-fri 06:00-18:00", scheduleTime(23, 20, 0), scheduleTime(26, 6, 0)},
+		{"sun 22:00-02:00", scheduleTime(18, 23, 0), scheduleTime(19, 2, 0)},
+		{"sun 22:00-02:00", scheduleTime(19, 1, 0), scheduleTime(19, 2, 0)}, // Window opened the day before
+		{"mon 06:00-12:00; mon 12:00-18:00", scheduleTime(19, 7, 0), scheduleTime(19, 18, 0)},
+		{"* 00:00-24:00", scheduleTime(19, 7, 0), time.Time{}}, // Never changes
+	}
+
+	for _, test := range tests {
+		s, err := parseSchedule(test.text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := s.change(test.t); !got.Equal(test.change) {
+			t.Errorf("'%s' at %s: changes at %s, want %s", test.text, test.t, got, test.change)
+		}
+	}
+}
@@ -5,15 +5,13 @@ import (
 	"fmt"
 	"log"
 	"sync"
-
-	"github.com/cyops-se/opc"
-	"github.com/go-ole/go-ole"
 )
 
 type Server struct {
-	ID     int    `json:id`
-	ProgID string `json:"progid"`
-	Cursor *ole.VARIANT
+	ID      int    `json:id`
+	ProgID  string `json:"progid"`
+	Type    string `json:"type"`
+	browser Browser
 }
 
 var servers []*Server
@@ -38,29 +36,16 @@ func Unlock() {
 func InitServers() {
 	defer handlePanic("InitServers")
 
-	// Test if we can connect Graybox.Simulator since we can't browse it
-
 	i := 0
-	if client, err := opc.NewConnection(
-		"Graybox.Simulator.1",                              // ProgId
-		[]string{"localhost"},                              //  OPC servers nodes
-		[]string{"numeric.sin.int64", "numeric.saw.float"}, // slice of OPC tags
-	); err == nil {
-		servers = append(servers, &Server{ProgID: "Graybox.Simulator", ID: i})
-		i++
-		defer client.Close()
-	}
-
-	if ao := opc.NewAutomationObject(); ao != nil {
-		serversfound := ao.GetOPCServers("localhost")
-		logger.Log("trace", "OPC server init", fmt.Sprintf("Found %d server(s) on '%s':\n", len(serversfound)+i, "localhost"))
-		for _, server := range serversfound {
-			logger.Log("trace", "OPC server found", server)
-			servers = append(servers, &Server{ProgID: server, ID: i})
+	for _, name := range DataSourceTypes() {
+		for _, progid := range dataSourceTypes[name].discover() {
+			servers = append(servers, &Server{ProgID: progid, Type: name, ID: i})
 			i++
 		}
-	} else {
-		logger.Log("error", "OPC server init failure", "Unable to get new automation object")
+	}
+
+	if len(servers) == 0 {
+		logger.Log("error", "OPC server init failure", "No data source servers found")
 	}
 }
 
@@ -78,19 +63,35 @@ func GetServer(sid int) (*Server, error) {
 	return servers[sid], nil
 }
 
-func GetBrowser(sid int) (*ole.VARIANT, error) {
+// GetServerByProgID returns the first discovered server with a matching program ID
+func GetServerByProgID(progid string) (*Server, error) {
+	for _, server := range servers {
+		if server.ProgID == progid {
+			return server, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no such server: %s", progid)
+}
+
+func GetBrowser(sid int) (Browser, error) {
 	defer handlePanic("GetBrowser")
 	server, err := GetServer(sid)
 	if err != nil {
-		logger.Error("Servers engine", "Failed to get server '%s', error: %s", sid, err)
+		logger.Error("Servers engine", "Failed to get server '%d', error: %s", sid, err)
 		return nil, err
 	}
 
-	if server.Cursor == nil {
-		mutex.Lock()
-		server.Cursor, err = opc.CreateBrowserCursor(server.ProgID, []string{"localhost"})
-		mutex.Unlock()
+	if server.browser == nil {
+		source, err := NewDataSource(server.Type)
+		if err != nil {
+			return nil, err
+		}
+
+		if server.browser, err = source.Browse(server.ProgID); err != nil {
+			return nil, err
+		}
 	}
 
-	return server.Cursor, err
+	return server.browser, nil
 }
@@ -24,7 +24,7 @@ func PutSetting(key string, value string) {
 func InitSetting(key string, value string, description string) types.KeyValuePair {
 	item, err := GetSetting(key)
 	if err != nil {
-		item := types.KeyValuePair{Key: key, Value: value, Extra: description}
+		item = types.KeyValuePair{Key: key, Value: value, Extra: description}
 		db.DB.Create(&item)
 	}
 
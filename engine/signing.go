@@ -0,0 +1,118 @@
+package engine
+
+import (
+	"dd-opcda/db"
+	"dd-opcda/logger"
+	"dd-opcda/sign"
+	"dd-opcda/types"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Signing keys are reloaded periodically so keys can be added and rotated without a
+// restart. Invalid keys and the key each proxy signs with are logged when they change
+var invalidKeys = map[uint]string{}
+var signingKeys = map[uint]int{}
+var signingMutex sync.Mutex
+
+// loadSigningKeys reads the signing keys of every proxy into its keyring
+func loadSigningKeys() {
+	signingMutex.Lock()
+	defer signingMutex.Unlock()
+
+	var items []types.SigningKey
+	db.DB.Order("id").Find(&items)
+
+	keys := map[uint][]sign.Key{}
+	for _, item := range items {
+		key, err := parseSigningKey(item)
+		if err != nil {
+			if invalidKeys[item.ID] != err.Error() {
+				invalidKeys[item.ID] = err.Error()
+				logger.Log("error", "Invalid signing key", fmt.Sprintf("Proxy ID: %d, %s", item.DiodeProxyID, err.Error()))
+			}
+			continue
+		}
+
+		delete(invalidKeys, item.ID)
+		keys[item.DiodeProxyID] = append(keys[item.DiodeProxyID], key)
+	}
+
+	now := time.Now()
+	for id, proxy := range proxies {
+		proxy.Keyring.Set(keys[id])
+
+		current := 0
+		if key, ok := proxy.Keyring.Signing(now); ok {
+			current = int(key.ID)
+		} else if len(keys[id]) > 0 {
+			current = -1
+		}
+
+		if last, ok := signingKeys[id]; (ok && last == current) || (!ok && current == 0) {
+			continue
+		}
+		signingKeys[id] = current
+
+		switch current {
+		case 0:
+			logger.Log("info", "Proxy signing disabled", fmt.Sprintf("Proxy: %s, no signing keys", proxy.Name))
+		case -1:
+			logger.Log("error", "No valid signing key", fmt.Sprintf("Proxy: %s, no key is valid now and packets are dropped", proxy.Name))
+		default:
+			logger.Log("info", "Proxy signing key", fmt.Sprintf("Proxy: %s, signing with key ID %d", proxy.Name, current))
+		}
+	}
+}
+
+// ValidateSigningKey checks the key ID, secret and validity of a signing key
+func ValidateSigningKey(item *types.SigningKey) error {
+	if item.NotBefore != nil && item.NotAfter != nil && !item.NotAfter.After(*item.NotBefore) {
+		return fmt.Errorf("key %d is never valid, notafter is not after notbefore", item.KeyID)
+	}
+
+	_, err := parseSigningKey(*item)
+	return err
+}
+
+func parseSigningKey(item types.SigningKey) (sign.Key, error) {
+	if item.KeyID < 1 || item.KeyID > 65535 {
+		return sign.Key{}, fmt.Errorf("key ID %d is not 1-65535", item.KeyID)
+	}
+
+	var notBefore, notAfter time.Time
+	if item.NotBefore != nil {
+		notBefore = *item.NotBefore
+	}
+	if item.NotAfter != nil {
+		notAfter = *item.NotAfter
+	}
+
+	return sign.ParseKey(uint16(item.KeyID), item.Secret, notBefore, notAfter)
+}
+
+// signingKeyLoader reloads the signing keys every 10 seconds
+func signingKeyLoader() {
+	defer handlePanic("signingKeyLoader")
+	ticker := time.NewTicker(10 * time.Second)
+	for {
+		<-ticker.C
+		loadSigningKeys()
+	}
+}
+
+// signPacket signs a packet with the proxy's current signing key, if it has keys
+func signPacket(proxy *types.DiodeProxy, data []byte) ([]byte, error) {
+	if proxy.Keyring == nil || proxy.Keyring.Len() == 0 {
+		return data, nil
+	}
+
+	now := time.Now()
+	key, ok := proxy.Keyring.Signing(now)
+	if !ok {
+		return nil, fmt.Errorf("no valid signing key, packet dropped")
+	}
+
+	return sign.Sign(data, key, now), nil
+}
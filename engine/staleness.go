@@ -0,0 +1,90 @@
+package engine
+
+import (
+	"dd-opcda/logger"
+	"dd-opcda/types"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// TagEvent is published as 'tag.stale' when a tag becomes, or is no longer, frozen or stale
+type TagEvent struct {
+	TagID  uint      `json:"tagid"`
+	Tag    string    `json:"tag"`
+	Group  string    `json:"group"`
+	Frozen bool      `json:"frozen"` // Value unchanged for longer than the frozen threshold
+	Stale  bool      `json:"stale"`  // Quality not good for longer than the stale threshold
+	Since  time.Time `json:"since"`  // When the value last changed, or quality was last good
+}
+
+// staleThresholds returns how long the value of a tag may be unchanged before it is
+// frozen and how long its quality may be non-good before it is stale. The tag's own
+// thresholds override the group's, and 0 disables the check
+func staleThresholds(tag *types.OPCTag, group *types.OPCGroup) (frozen time.Duration, stale time.Duration) {
+	frozenAfter, staleAfter := group.FrozenAfter, group.StaleAfter
+	if tag != nil && tag.FrozenAfter > 0 {
+		frozenAfter = tag.FrozenAfter
+	}
+	if tag != nil && tag.StaleAfter > 0 {
+		staleAfter = tag.StaleAfter
+	}
+
+	return time.Duration(frozenAfter) * time.Second, time.Duration(staleAfter) * time.Second
+}
+
+// observe tracks how long the collected value has been unchanged and the quality
+// non-good, see checkStale
+func (s *tagState) observe(item DataItem, now time.Time) {
+	good := item.Quality&types.QualityStatusMask == types.QualityGood
+	if s.observed == nil || !reflect.DeepEqual(item.Value, s.observed.Value) {
+		s.changedTime = now
+	}
+	if s.observed == nil || good {
+		s.goodTime = now
+	}
+	s.observed = &item
+}
+
+// checkStale returns the point flags of the last observed item of the tag at now and
+// whether they changed. It is checked for each collected item and swept over all tags
+// every cycle, so tags that are not collected again, such as unchanged tags in
+// subscription mode, still become frozen or stale
+func (s *tagState) checkStale(now time.Time, frozen time.Duration, stale time.Duration) (flags int, changed bool) {
+	if s.observed == nil {
+		return 0, false
+	}
+
+	good := s.observed.Quality&types.QualityStatusMask == types.QualityGood
+	if frozen > 0 && good && now.Sub(s.changedTime) >= frozen {
+		flags |= types.PointFlagFrozen
+	}
+	if stale > 0 && !good && now.Sub(s.goodTime) >= stale {
+		flags |= types.PointFlagStale
+	}
+
+	changed = flags != s.flags
+	s.flags = flags
+	return flags, changed
+}
+
+// notifyStale logs and publishes a change of the frozen and stale flags of a tag
+func notifyStale(tag *types.OPCTag, name string, group *types.OPCGroup, state *tagState) {
+	event := TagEvent{Tag: name, Group: group.Name, Frozen: state.flags&types.PointFlagFrozen != 0, Stale: state.flags&types.PointFlagStale != 0}
+	if tag != nil {
+		event.TagID = tag.ID
+	}
+
+	switch {
+	case event.Frozen:
+		event.Since = state.changedTime
+		logger.Log("warning", "Frozen tag value", fmt.Sprintf("Tag: %s, group: %s, unchanged since: %s", name, group.Name, event.Since.Format(time.RFC3339)))
+	case event.Stale:
+		event.Since = state.goodTime
+		logger.Log("warning", "Stale tag value", fmt.Sprintf("Tag: %s, group: %s, not good quality since: %s", name, group.Name, event.Since.Format(time.RFC3339)))
+	default:
+		logger.Log("info", "Tag value recovered", fmt.Sprintf("Tag: %s, group: %s, no longer frozen or stale", name, group.Name))
+	}
+
+	logger.NotifySubscribers("tag.stale", event)
+}
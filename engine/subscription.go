@@ -0,0 +1,80 @@
+package engine
+
+import (
+	"dd-opcda/types"
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+)
+
+// Subscriber is implemented by data sources that push changed items to the collector
+// instead of being polled. The deadband is in percent of the item's engineering range.
+// Pushed items just stop when the connection is lost, so the collector calls Check
+// every cycle, which returns an error if the connection is lost
+type Subscriber interface {
+	Subscribe(rate time.Duration, deadband float64, changed func(map[string]DataItem)) error
+	Unsubscribe()
+	Check() error
+}
+
+// changeFilter passes items that changed quality or moved more than the percent deadband
+// since they were last passed. Items without a known range pass on any change
+type changeFilter struct {
+	deadband float64
+	ranges   func(name string) (low float64, high float64, ok bool)
+	last     map[string]DataItem
+}
+
+func newChangeFilter(deadband float64, ranges func(string) (float64, float64, bool)) *changeFilter {
+	return &changeFilter{deadband: deadband, ranges: ranges, last: make(map[string]DataItem)}
+}
+
+func (f *changeFilter) filter(items map[string]DataItem) map[string]DataItem {
+	changed := make(map[string]DataItem)
+	for name, item := range items {
+		if last, ok := f.last[name]; ok && !f.changed(name, last, item) {
+			continue
+		}
+
+		f.last[name] = item
+		changed[name] = item
+	}
+
+	return changed
+}
+
+func (f *changeFilter) changed(name string, last DataItem, item DataItem) bool {
+	if last.Quality != item.Quality {
+		return true
+	}
+
+	value, ok := toFloat(item.Value)
+	lastvalue, lastok := toFloat(last.Value)
+	if !ok || !lastok {
+		return !reflect.DeepEqual(last.Value, item.Value)
+	}
+
+	if low, high, ok := f.ranges(name); ok && f.deadband > 0 && high > low {
+		return math.Abs(value-lastvalue) > f.deadband/100.0*(high-low)
+	}
+
+	return value != lastvalue
+}
+
+// subscribe starts pushing the changed items of the group's data source to the changed
+// callback, checked at the update rate of the group. All items are subscribed, rate
+// multiples only apply to polling
+func subscribe(source DataSource, group *types.OPCGroup, changed func(map[string]DataItem)) (Subscriber, error) {
+	subscriber, ok := source.(Subscriber)
+	if !ok {
+		return nil, fmt.Errorf("data source type %s does not support subscriptions", groupSourceType(group))
+	}
+
+	rate := time.Duration(group.UpdateRate) * time.Millisecond
+	if rate <= 0 {
+		rate = time.Duration(group.Interval) * time.Millisecond
+	}
+
+	return subscriber, subscriber.Subscribe(rate, group.PercentDeadband, changed)
+}
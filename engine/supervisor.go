@@ -0,0 +1,181 @@
+package engine
+
+import (
+	stdcontext "context" // engine has its own file transfer context type
+	"dd-opcda/db"
+	"dd-opcda/logger"
+	"dd-opcda/types"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// groupRunner is the supervisor's handle on the collector goroutine of one group
+type groupRunner struct {
+	group     *types.OPCGroup
+	collected *types.OPCGroup // The collector's own copy of the group
+	cancel    stdcontext.CancelFunc
+	done      chan struct{}
+	state     string
+}
+
+var runners = map[uint]*groupRunner{}
+var runnersMutex sync.Mutex
+
+// GroupState returns the lifecycle state of a group's collector
+func GroupState(id uint) string {
+	runnersMutex.Lock()
+	defer runnersMutex.Unlock()
+
+	if runner, ok := runners[id]; ok {
+		return runner.state
+	}
+
+	return types.GroupStateStopped
+}
+
+// setGroupState moves a group to a new lifecycle state, keeps the persisted status
+// in line with it and notifies subscribers with the 'group.state' event
+func setGroupState(group *types.OPCGroup, state string) {
+	runnersMutex.Lock()
+	if runner, ok := runners[group.ID]; ok && (runner.group == group || runner.collected == group) {
+		runner.state = state
+	}
+	runnersMutex.Unlock()
+
+	group.State = state
+	switch state {
+	case types.GroupStateRunning:
+		group.Status = types.GroupStatusRunning
+	case types.GroupStateDegraded:
+		group.Status = types.GroupStatusRunningWithWarning
+	default:
+		group.Status = types.GroupStatusNotRunning
+	}
+
+	db.DB.Model(group).Update("status", group.Status)
+	fillSchedule(group)
+	logger.NotifySubscribers("group.state", group)
+}
+
+func Start(group *types.OPCGroup) (err error) {
+	defer handlePanic("Start")
+	if err = ValidateGroup(group); err != nil {
+		logger.Log("error", "OPC collection start failed", err.Error())
+		return
+	}
+
+	var tags []*types.OPCTag
+	db.DB.Table("opc_tags").Find(&tags, "group_id = ?", group.ID)
+	if len(tags) <= 0 {
+		err = fmt.Errorf("Group does not have any tags defined, group: %s (id: %d)", group.Name, group.ID)
+		logger.Log("error", "OPC collection start failed", err.Error())
+		return
+	}
+
+	// Make sure the group is not already running, or still stopping
+	runnersMutex.Lock()
+	if runner, ok := runners[group.ID]; ok {
+		state := runner.state
+		runnersMutex.Unlock()
+		err = fmt.Errorf("Group already %s, group: %s (id: %d)", state, group.Name, group.ID)
+		logger.Log("error", "OPC collection start failed", err.Error())
+		return
+	}
+
+	// The collector updates its own copy of the group, so the caller's group is not
+	// shared with it
+	ctx, cancel := stdcontext.WithCancel(stdcontext.Background())
+	collected := *group
+	runner := &groupRunner{group: group, collected: &collected, cancel: cancel, done: make(chan struct{}), state: types.GroupStateStarting}
+	runners[group.ID] = runner
+	runnersMutex.Unlock()
+
+	setGroupState(group, types.GroupStateStarting)
+	collected.State, collected.Status = group.State, group.Status
+
+	go func() {
+		// A runner abandoned by Stop leaves the group alone, it may have been started again
+		defer func() {
+			if runnerCurrent(runner) {
+				setGroupState(runner.collected, types.GroupStateStopped)
+			}
+
+			runnersMutex.Lock()
+			if runners[group.ID] == runner {
+				delete(runners, group.ID)
+			}
+			runnersMutex.Unlock()
+			close(runner.done)
+		}()
+
+		groupDataCollector(ctx.Done(), runner, tags)
+	}()
+
+	return
+}
+
+// runnerCurrent returns true if the runner is the one the supervisor has for its group
+func runnerCurrent(runner *groupRunner) bool {
+	runnersMutex.Lock()
+	defer runnersMutex.Unlock()
+	return runners[runner.group.ID] == runner
+}
+
+// Stop cancels the collector of a group and waits for it to finish. If it does not
+// finish within 'group.stoptimeout' the collector is abandoned and the group is
+// stopped, so it can be started again
+func Stop(group *types.OPCGroup) (err error) {
+	defer handlePanic("Stop")
+	runnersMutex.Lock()
+	runner, ok := runners[group.ID]
+	if !ok || runner.state == types.GroupStateStopping {
+		runnersMutex.Unlock()
+		err = fmt.Errorf("Group not running, group: %s (id: %d)", group.Name, group.ID)
+		logger.Log("error", "OPC collection stop failed", err.Error())
+		return
+	}
+	runnersMutex.Unlock()
+
+	setGroupState(runner.group, types.GroupStateStopping)
+	runner.cancel()
+
+	seconds, _ := strconv.Atoi(InitSetting("group.stoptimeout", "10", "Seconds to wait for a group collector to stop").Value)
+	select {
+	case <-runner.done:
+		group.Status = runner.collected.Status
+		group.State = runner.collected.State
+	case <-time.After(time.Duration(seconds) * time.Second):
+		err = fmt.Errorf("Group did not stop within %d seconds and its collector was abandoned, group: %s (id: %d)", seconds, group.Name, group.ID)
+		logger.Log("error", "OPC collection stop failed", err.Error())
+
+		runnersMutex.Lock()
+		if runners[group.ID] == runner {
+			delete(runners, group.ID)
+		}
+		runnersMutex.Unlock()
+
+		runner.group.LastError = err.Error()
+		db.DB.Model(runner.group).Update("last_error", runner.group.LastError)
+		setGroupState(runner.group, types.GroupStateStopped)
+		group.Status = runner.group.Status
+		group.State = runner.group.State
+	}
+
+	return
+}
+
+// StopGroups stops the collectors of all running groups
+func StopGroups() {
+	runnersMutex.Lock()
+	groups := make([]*types.OPCGroup, 0, len(runners))
+	for _, runner := range runners {
+		groups = append(groups, runner.group)
+	}
+	runnersMutex.Unlock()
+
+	for _, group := range groups {
+		Stop(group)
+	}
+}
@@ -0,0 +1,78 @@
+package engine
+
+import "time"
+
+// cycleTimer fires every interval like a time.Ticker, but ticks that were missed
+// because a cycle overran are skipped instead of firing late back to back. Aligned
+// timers fire on wall-clock multiples of the interval, e.g. on :00 of every minute
+type cycleTimer struct {
+	C        <-chan time.Time
+	interval time.Duration
+	next     time.Time
+	timer    *time.Timer
+	missed   uint
+	jitter   jitterStats
+}
+
+// jitterStats measures how late ticks fire compared to when they were scheduled
+type jitterStats struct {
+	count uint64
+	sum   time.Duration
+	max   time.Duration
+}
+
+func newCycleTimer(interval time.Duration, align bool) *cycleTimer {
+	now := time.Now()
+	t := &cycleTimer{interval: interval, next: now.Add(interval)}
+	if align {
+		t.next = now.Truncate(interval).Add(interval)
+	}
+
+	t.timer = time.NewTimer(t.next.Sub(now))
+	t.C = t.timer.C
+	return t
+}
+
+// advance schedules the next tick and must be called after each receive from C. It
+// returns the number of ticks skipped since the previous one
+func (t *cycleTimer) advance() uint {
+	now := time.Now()
+	t.jitter.add(now.Sub(t.next))
+	t.next = t.next.Add(t.interval)
+
+	var skipped uint
+	if now.After(t.next) {
+		skipped = uint(now.Sub(t.next)/t.interval) + 1
+		t.next = t.next.Add(time.Duration(skipped) * t.interval)
+	}
+
+	t.missed += skipped
+	t.timer.Reset(t.next.Sub(now))
+	return skipped
+}
+
+func (t *cycleTimer) Stop() {
+	t.timer.Stop()
+}
+
+func (s *jitterStats) add(jitter time.Duration) {
+	s.count++
+	s.sum += jitter
+	if jitter > s.max {
+		s.max = jitter
+	}
+}
+
+// mean returns the average jitter in milliseconds
+func (s *jitterStats) mean() float64 {
+	if s.count == 0 {
+		return 0
+	}
+
+	return float64(s.sum) / float64(s.count) / float64(time.Millisecond)
+}
+
+// maximum returns the largest jitter in milliseconds
+func (s *jitterStats) maximum() float64 {
+	return float64(s.max) / float64(time.Millisecond)
+}
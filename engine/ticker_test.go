@@ -0,0 +1,82 @@
+package engine
+
+import (
+	"testing"
+	"time"
+)
+
+// tick waits for the next tick of the timer, failing the test if it does not come
+func tick(t *testing.T, timer *cycleTimer) time.Time {
+	t.Helper()
+	select {
+	case now := <-timer.C:
+		return now
+	case <-time.After(5 * time.Second):
+		t.Fatal("cycle timer did not fire")
+	}
+
+	return time.Time{}
+}
+
+func TestCycleTimer(t *testing.T) {
+	interval := 50 * time.Millisecond
+	start := time.Now()
+	timer := newCycleTimer(interval, false)
+	defer timer.Stop()
+
+	for i := 1; i <= 3; i++ {
+		if now := tick(t, timer); now.Sub(start) < time.Duration(i)*interval {
+			t.Fatalf("tick %d after %s, want %s", i, now.Sub(start), time.Duration(i)*interval)
+		}
+		if skipped := timer.advance(); skipped != 0 {
+			t.Errorf("tick %d skipped %d ticks", i, skipped)
+		}
+	}
+
+	if timer.jitter.count != 3 || timer.jitter.mean() < 0 || timer.jitter.maximum() < timer.jitter.mean() {
+		t.Errorf("jitter of %d ticks, mean %f ms max %f ms", timer.jitter.count, timer.jitter.mean(), timer.jitter.maximum())
+	}
+}
+
+func TestCycleTimerSkips(t *testing.T) {
+	interval := 100 * time.Millisecond
+	timer := newCycleTimer(interval, false)
+	defer timer.Stop()
+	first := timer.next
+
+	// A cycle overrunning three and a half intervals skips the three ticks it missed
+	tick(t, timer)
+	time.Sleep(interval*3 + interval/2)
+	if skipped := timer.advance(); skipped != 3 {
+		t.Errorf("skipped %d ticks, want 3", skipped)
+	}
+	if timer.missed != 3 {
+		t.Errorf("missed %d ticks, want 3", timer.missed)
+	}
+
+	// The next tick keeps the phase of the first, instead of firing at once
+	if timer.next.Sub(first) != 4*interval {
+		t.Errorf("next tick %s after the first, want %s", timer.next.Sub(first), 4*interval)
+	}
+	if now := tick(t, timer); now.Before(timer.next) {
+		t.Errorf("tick fired %s early", timer.next.Sub(now))
+	}
+}
+
+func TestCycleTimerAligned(t *testing.T) {
+	interval := 100 * time.Millisecond
+	timer := newCycleTimer(interval, true)
+	defer timer.Stop()
+
+	for i := 0; i < 2; i++ {
+		if !timer.next.Equal(timer.next.Truncate(interval)) {
+			t.Errorf("tick at %s, want a multiple of %s", timer.next.Format("15:04:05.000000"), interval)
+		}
+		if until := time.Until(timer.next); until > interval {
+			t.Errorf("next tick in %s, want within %s", until, interval)
+		}
+
+		tick(t, timer)
+		timer.advance()
+	}
+}
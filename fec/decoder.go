@@ -0,0 +1,149 @@
+package fec
+
+import (
+	"errors"
+	"fmt"
+)
+
+// DecoderWindow is the number of groups the decoder keeps waiting for lost packets
+const DecoderWindow = 64
+
+// ErrNoHeader is returned for packets that do not start with a valid FEC header
+var ErrNoHeader = errors.New("packet has no valid FEC header")
+
+// Decoder removes the FEC headers from a stream of packets and recovers lost packets.
+// Use one decoder per stream, that is per channel and path, and only for paths where
+// the sender has FEC enabled: packets are not checked for a header to tell whether
+// FEC is used, as payloads may start with bytes that look like one
+type Decoder struct {
+	groups  map[uint32]*decoderGroup
+	newest  uint32
+	started bool
+}
+
+type decoderGroup struct {
+	count    int // Number of data packets, known from the group size or the parity packet
+	received map[int]bool
+	xor      []byte // XOR of the parity and the received payloads
+	length   int    // XOR of the parity length and the received lengths
+	parity   bool
+	done     bool
+}
+
+// NewDecoder returns a decoder of a new stream
+func NewDecoder() *Decoder {
+	return &Decoder{groups: map[uint32]*decoderGroup{}}
+}
+
+// Decode returns the payloads a received packet delivers: the payload of a data packet,
+// unless it is a duplicate, and a recovered payload when the packet leaves exactly one
+// lost data packet in a group with parity. Packets without a valid FEC header return
+// ErrNoHeader. Recovered payloads may be delivered after later packets
+func (d *Decoder) Decode(packet []byte) ([][]byte, error) {
+	h, ok := readHeader(packet)
+	if !ok {
+		return nil, ErrNoHeader
+	}
+
+	payload := packet[HeaderSize:]
+	if h.kind == KindData && h.length > len(payload) {
+		return nil, fmt.Errorf("FEC packet %d of group %d is truncated", h.index, h.group)
+	}
+
+	g := d.group(h.group)
+	if g == nil {
+		return nil, nil // Too old
+	}
+
+	var payloads [][]byte
+	switch h.kind {
+	case KindData:
+		if g.received[h.index] {
+			return nil, nil
+		}
+
+		payload = payload[:h.length]
+		g.received[h.index] = true
+		g.add(payload, h.length)
+		if !g.parity && g.count == 0 {
+			g.count = h.count
+		}
+		payloads = append(payloads, payload)
+	case KindParity:
+		if g.parity {
+			return nil, nil
+		}
+
+		g.parity = true
+		g.count = h.count
+		g.add(payload, h.length)
+	}
+
+	if recovered := g.recover(); recovered != nil {
+		payloads = append(payloads, recovered)
+	}
+
+	return payloads, nil
+}
+
+// group returns the state of a group, or nil if the group is older than the window
+func (d *Decoder) group(id uint32) *decoderGroup {
+	if !d.started || int32(id-d.newest) > 0 {
+		d.newest = id
+		d.started = true
+		for old := range d.groups {
+			if int32(d.newest-old) >= DecoderWindow {
+				delete(d.groups, old)
+			}
+		}
+	}
+
+	if int32(d.newest-id) >= DecoderWindow {
+		return nil
+	}
+
+	g, ok := d.groups[id]
+	if !ok {
+		g = &decoderGroup{received: map[int]bool{}}
+		d.groups[id] = g
+	}
+
+	return g
+}
+
+func (g *decoderGroup) add(payload []byte, length int) {
+	if len(payload) > len(g.xor) {
+		g.xor = append(g.xor, make([]byte, len(payload)-len(g.xor))...)
+	}
+	for i, b := range payload {
+		g.xor[i] ^= b
+	}
+	g.length ^= length
+}
+
+// recover returns the lost data packet's payload if the parity and all other data
+// packets of the group have been received
+func (g *decoderGroup) recover() []byte {
+	if g.done || !g.parity || len(g.received) != g.count-1 {
+		if g.parity && len(g.received) == g.count {
+			g.done = true // Nothing lost
+		}
+		return nil
+	}
+
+	g.done = true
+	for index := 0; index < g.count; index++ {
+		if !g.received[index] {
+			g.received[index] = true
+			break
+		}
+	}
+
+	if g.length > len(g.xor) {
+		return nil
+	}
+
+	payload := make([]byte, g.length)
+	copy(payload, g.xor)
+	return payload
+}
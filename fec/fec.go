@@ -0,0 +1,147 @@
+package fec
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+)
+
+// Forward error correction with XOR parity. Packets are sent in groups of up to
+// MaxGroupSize packets, each with a header, and every group is followed by a parity
+// packet holding the XOR of the group's payloads, so the receiver can recover one lost
+// packet per group. The header is:
+//
+//	magic   uint16 big endian, Magic
+//	kind    byte, KindData or KindParity
+//	count   byte, the group size for data packets, and the number of data packets in
+//	        the group for parity packets, which is less for groups sent incomplete
+//	index   byte, the packet's index in the group, the count for parity packets
+//	group   uint32 big endian, group sequence number
+//	length  uint16 big endian, payload length, or the XOR of the lengths for parity
+//	check   uint16 big endian, the low 16 bits of the CRC-32 of the header before it
+//
+// Parity payloads are as long as the longest payload of the group, with shorter
+// payloads padded with zeroes. The magic and check make it unlikely that a packet
+// without a header is taken for one, but receivers decode FEC only on paths where the
+// sender has it enabled, see Decoder.
+const (
+	Magic        = 0xFEC1
+	KindData     = 0
+	KindParity   = 1
+	HeaderSize   = 13
+	MaxGroupSize = 255
+)
+
+type header struct {
+	kind   byte
+	count  int
+	index  int
+	group  uint32
+	length int
+}
+
+// Encoder adds FEC headers to a stream of packets and returns a parity packet after
+// every group
+type Encoder struct {
+	size   int
+	group  uint32
+	index  int
+	parity []byte
+	length uint16
+}
+
+// NewEncoder returns an encoder of groups of size packets, at most MaxGroupSize
+func NewEncoder(size int) *Encoder {
+	if size > MaxGroupSize {
+		size = MaxGroupSize
+	}
+	if size < 1 {
+		size = 1
+	}
+
+	return &Encoder{size: size}
+}
+
+// Encode returns the payload as a data packet, followed by the group's parity packet if
+// the payload completes the group
+func (e *Encoder) Encode(payload []byte) [][]byte {
+	packet := make([]byte, HeaderSize+len(payload))
+	putHeader(packet, header{kind: KindData, count: e.size, index: e.index, group: e.group, length: len(payload)})
+	copy(packet[HeaderSize:], payload)
+
+	if len(payload) > len(e.parity) {
+		e.parity = append(e.parity, make([]byte, len(payload)-len(e.parity))...)
+	}
+	for i, b := range payload {
+		e.parity[i] ^= b
+	}
+	e.length ^= uint16(len(payload))
+	e.index++
+
+	if e.index < e.size {
+		return [][]byte{packet}
+	}
+
+	return [][]byte{packet, e.Flush()}
+}
+
+// Pending returns true if packets have been sent since the last parity packet
+func (e *Encoder) Pending() bool {
+	return e.index > 0
+}
+
+// Flush returns the parity packet of the current group and starts a new group. It
+// returns nil if the group is empty
+func (e *Encoder) Flush() []byte {
+	if e.index == 0 {
+		return nil
+	}
+
+	packet := make([]byte, HeaderSize+len(e.parity))
+	putHeader(packet, header{kind: KindParity, count: e.index, index: e.index, group: e.group, length: int(e.length)})
+	copy(packet[HeaderSize:], e.parity)
+
+	e.group++
+	e.index = 0
+	e.parity = e.parity[:0]
+	e.length = 0
+	return packet
+}
+
+func putHeader(packet []byte, h header) {
+	binary.BigEndian.PutUint16(packet[0:2], Magic)
+	packet[2] = h.kind
+	packet[3] = byte(h.count)
+	packet[4] = byte(h.index)
+	binary.BigEndian.PutUint32(packet[5:9], h.group)
+	binary.BigEndian.PutUint16(packet[9:11], uint16(h.length))
+	binary.BigEndian.PutUint16(packet[11:13], headerCheck(packet))
+}
+
+// readHeader returns the header of a packet, and false if the packet does not start
+// with a valid header
+func readHeader(packet []byte) (h header, ok bool) {
+	if len(packet) < HeaderSize || binary.BigEndian.Uint16(packet[0:2]) != Magic || binary.BigEndian.Uint16(packet[11:13]) != headerCheck(packet) {
+		return h, false
+	}
+
+	h.kind = packet[2]
+	h.count = int(packet[3])
+	h.index = int(packet[4])
+	h.group = binary.BigEndian.Uint32(packet[5:9])
+	h.length = int(binary.BigEndian.Uint16(packet[9:11]))
+
+	switch {
+	case h.count == 0:
+		return h, false
+	case h.kind == KindData:
+		return h, h.index < h.count
+	case h.kind == KindParity:
+		return h, h.index == h.count
+	}
+
+	return h, false
+}
+
+func headerCheck(packet []byte) uint16 {
+	return uint16(crc32.ChecksumIEEE(packet[:HeaderSize-2]))
+}
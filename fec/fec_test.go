@@ -0,0 +1,242 @@
+package fec
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// payloads returns count payloads of different lengths, some ending in zeroes and one
+// empty, so recovery must restore the exact length
+func payloads(count int, seed int64) [][]byte {
+	r := rand.New(rand.NewSource(seed))
+	lengths := []int{1400, 1, 0, 37, 512, 3, 1399, 64}
+	result := make([][]byte, count)
+	for i := range result {
+		result[i] = make([]byte, lengths[(i+int(seed))%len(lengths)])
+		r.Read(result[i])
+		if len(result[i]) > 2 && i%2 == 0 {
+			result[i][len(result[i])-1] = 0
+			result[i][len(result[i])-2] = 0
+		}
+	}
+
+	return result
+}
+
+// encode returns the packets of the payloads, with the parity of an incomplete last
+// group flushed
+func encode(size int, data [][]byte) [][]byte {
+	e := NewEncoder(size)
+	var packets [][]byte
+	for _, payload := range data {
+		packets = append(packets, e.Encode(payload)...)
+	}
+	if e.Pending() {
+		packets = append(packets, e.Flush())
+	}
+
+	return packets
+}
+
+// decode returns the payloads delivered by a decoder of the packets
+func decode(t *testing.T, packets [][]byte) [][]byte {
+	d := NewDecoder()
+	var result [][]byte
+	for _, packet := range packets {
+		delivered, err := d.Decode(packet)
+		if err != nil {
+			t.Fatalf("decoding failed: %s", err)
+		}
+		result = append(result, delivered...)
+	}
+
+	return result
+}
+
+// sameSet fails the test unless got holds the payloads of want, in any order
+func sameSet(t *testing.T, got [][]byte, want [][]byte) {
+	t.Helper()
+	sorted := func(items [][]byte) []string {
+		texts := make([]string, len(items))
+		for i, item := range items {
+			texts[i] = string(item)
+		}
+		sort.Strings(texts)
+		return texts
+	}
+
+	g, w := sorted(got), sorted(want)
+	if len(g) != len(w) {
+		t.Fatalf("delivered %d payloads, want %d", len(g), len(w))
+	}
+	for i := range g {
+		if g[i] != w[i] {
+			t.Fatalf("delivered payloads differ from the sent payloads")
+		}
+	}
+}
+
+func without(packets [][]byte, index int) [][]byte {
+	result := append([][]byte(nil), packets[:index]...)
+	return append(result, packets[index+1:]...)
+}
+
+func TestRecoverEachIndex(t *testing.T) {
+	tests := []struct {
+		size  int
+		count int // Data packets sent, fewer than size for a group flushed early
+	}{
+		{1, 1},
+		{2, 2},
+		{4, 4},
+		{4, 3},
+		{4, 1},
+		{7, 7},
+		{7, 5},
+		{MaxGroupSize, MaxGroupSize},
+		{MaxGroupSize, 17},
+	}
+
+	for _, test := range tests {
+		data := payloads(test.count, int64(test.size))
+		packets := encode(test.size, data)
+		if len(packets) != test.count+1 {
+			t.Fatalf("size %d: %d packets for %d payloads", test.size, len(packets), test.count)
+		}
+
+		for lost := 0; lost < test.count; lost++ {
+			t.Run(fmt.Sprintf("size %d count %d lost %d", test.size, test.count, lost), func(t *testing.T) {
+				got := decode(t, without(packets, lost))
+				sameSet(t, got, data)
+				if !bytes.Equal(got[len(got)-1], data[lost]) {
+					t.Errorf("recovered payload differs from the lost payload")
+				}
+			})
+		}
+	}
+}
+
+func TestLostParity(t *testing.T) {
+	data := payloads(4, 1)
+	packets := encode(4, data)
+	sameSet(t, decode(t, packets[:len(packets)-1]), data)
+}
+
+func TestTwoLost(t *testing.T) {
+	data := payloads(4, 2)
+	packets := encode(4, data)
+	got := decode(t, without(without(packets, 3), 1))
+	sameSet(t, got, [][]byte{data[0], data[2]})
+}
+
+func TestDuplicates(t *testing.T) {
+	data := payloads(5, 3)
+	packets := encode(5, data)
+
+	var doubled [][]byte
+	for _, packet := range without(packets, 2) {
+		doubled = append(doubled, packet, packet)
+	}
+
+	// The lost packet arriving late after its recovery is a duplicate too
+	doubled = append(doubled, packets[2])
+	sameSet(t, decode(t, doubled), data)
+}
+
+func TestReordered(t *testing.T) {
+	data := payloads(24, 4)
+	packets := encode(6, data) // 4 groups of 6 data packets and a parity packet
+	r := rand.New(rand.NewSource(4))
+
+	for round := 0; round < 50; round++ {
+		lost := map[int]bool{}
+		for group := 0; group < 4; group++ {
+			lost[group*7+r.Intn(7)] = true
+		}
+
+		var received [][]byte
+		for _, i := range r.Perm(len(packets)) {
+			if !lost[i] {
+				received = append(received, packets[i])
+			}
+		}
+
+		sameSet(t, decode(t, received), data)
+	}
+}
+
+func TestParityFirst(t *testing.T) {
+	tests := []struct {
+		size  int
+		count int
+	}{
+		{4, 4},
+		{4, 2}, // Parity of a group flushed early has a smaller count than the data packets
+	}
+
+	for _, test := range tests {
+		data := payloads(test.count, 5)
+		packets := encode(test.size, data)
+		parity := packets[len(packets)-1]
+
+		for lost := 0; lost < test.count; lost++ {
+			received := append([][]byte{parity}, without(packets[:len(packets)-1], lost)...)
+			got := decode(t, received)
+			sameSet(t, got, data)
+			if !bytes.Equal(got[len(got)-1], data[lost]) {
+				t.Errorf("size %d count %d: recovered payload differs from lost payload %d", test.size, test.count, lost)
+			}
+		}
+	}
+}
+
+func TestWindow(t *testing.T) {
+	data := payloads(DecoderWindow+2, 6)
+	packets := encode(1, data) // A data and a parity packet per group
+
+	d := NewDecoder()
+	for _, packet := range packets[2:] {
+		if _, err := d.Decode(packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The first group is now beyond the window
+	if delivered, err := d.Decode(packets[0]); err != nil || len(delivered) != 0 {
+		t.Errorf("packet of a group beyond the window delivered %d payloads, err: %v", len(delivered), err)
+	}
+}
+
+func TestInvalidHeaders(t *testing.T) {
+	valid := encode(4, [][]byte{[]byte("payload")})[0]
+	corrupt := append([]byte(nil), valid...)
+	corrupt[6] ^= 1
+	truncated := append([]byte(nil), valid[:HeaderSize+3]...)
+
+	tests := []struct {
+		name   string
+		packet []byte
+		err    error
+	}{
+		{"empty", nil, ErrNoHeader},
+		{"short", valid[:HeaderSize-1], ErrNoHeader},
+		{"JSON", []byte(`{"version":2,"group":"g"}`), ErrNoHeader},
+		{"file chunk 254", append([]byte{0xFE, 0x00, 0x00, 0x00}, make([]byte, 40)...), ErrNoHeader},
+		{"magic only", append([]byte{0xFE, 0xC1, KindData, 4, 0}, make([]byte, 40)...), ErrNoHeader},
+		{"corrupt header", corrupt, ErrNoHeader},
+		{"truncated", truncated, nil},
+	}
+
+	for _, test := range tests {
+		delivered, err := NewDecoder().Decode(test.packet)
+		if err == nil || (test.err != nil && err != test.err) {
+			t.Errorf("%s: err %v, want %v", test.name, err, test.err)
+		}
+		if len(delivered) != 0 {
+			t.Errorf("%s: delivered %d payloads", test.name, len(delivered))
+		}
+	}
+}
@@ -9,9 +9,6 @@ import (
 	"flag"
 	"fmt"
 	"log"
-
-	"github.com/cyops-se/opc"
-	"golang.org/x/sys/windows/svc"
 )
 
 // type DataPoint struct {
@@ -71,10 +68,10 @@ func main() {
 	}
 
 	if ctx.TraceOpc {
-		opc.Debug()
+		engine.TraceDataSources()
 	}
 
-	inService, err := svc.IsWindowsService()
+	inService, err := isWindowsService()
 	if err != nil {
 		log.Fatalf("failed to determine if we are running in service: %v", err)
 	}
@@ -85,6 +82,7 @@ func main() {
 
 	// runEngine()
 	runService(svcName, true)
+	engine.StopGroups()
 	engine.CloseCache()
 }
 
@@ -92,8 +90,8 @@ func runEngine() {
 	defer handlePanic()
 
 	db.ConnectDatabase(ctx)
+	engine.InitServers() // Groups resolve their data source type from the discovered servers
 	engine.InitGroups()
-	engine.InitServers()
 	engine.InitCache()
 	engine.InitFileTransfer(ctx)
 	go web.RunWeb(ctx)
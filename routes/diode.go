@@ -0,0 +1,97 @@
+package routes
+
+import (
+	"dd-opcda/db"
+	"dd-opcda/engine"
+	"dd-opcda/logger"
+	"dd-opcda/types"
+	"fmt"
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func RegisterDiodeRoutes(api fiber.Router) {
+	api.Get("/diode/proxy", GetProxies)
+
+	// Signing key secrets are write-only, so signing keys are not generic CRUD data
+	api.Get("/diode/signingkey", GetSigningKeys)
+	api.Post("/diode/signingkey", NewSigningKey)
+	api.Put("/diode/signingkey/:id", UpdateSigningKey)
+	api.Delete("/diode/signingkey/:id", DeleteSigningKey)
+}
+
+func GetProxies(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusOK).JSON(engine.GetProxies())
+}
+
+func GetSigningKeys(c *fiber.Ctx) error {
+	var keys []types.SigningKey
+	if err := db.DB.Order("id").Find(&keys).Error; err != nil {
+		logger.Log("error", "GetSigningKeys failed", fmt.Sprintf("%v", err))
+		return c.Status(503).SendString(err.Error())
+	}
+
+	return c.Status(http.StatusOK).JSON(keys)
+}
+
+func NewSigningKey(c *fiber.Ctx) error {
+	var data types.SigningKeyData
+	if err := c.BodyParser(&data); err != nil {
+		logger.Log("error", "NewSigningKey failed (bind)", fmt.Sprintf("%v", err))
+		return c.Status(http.StatusBadRequest).SendString(err.Error())
+	}
+
+	key := &types.SigningKey{DiodeProxyID: data.DiodeProxyID, KeyID: data.KeyID, Secret: data.Secret, NotBefore: data.NotBefore, NotAfter: data.NotAfter}
+	return saveSigningKey(c, key)
+}
+
+func UpdateSigningKey(c *fiber.Ctx) error {
+	var data types.SigningKeyData
+	if err := c.BodyParser(&data); err != nil {
+		logger.Log("error", "UpdateSigningKey failed (bind)", fmt.Sprintf("%v", err))
+		return c.Status(http.StatusBadRequest).SendString(err.Error())
+	}
+
+	var key types.SigningKey
+	if err := db.DB.First(&key, "id = ?", c.Params("id")).Error; err != nil {
+		logger.Log("error", "UpdateSigningKey failed (first)", fmt.Sprintf("%v", err))
+		return c.Status(http.StatusNotFound).SendString(err.Error())
+	}
+
+	key.DiodeProxyID = data.DiodeProxyID
+	key.KeyID = data.KeyID
+	key.NotBefore = data.NotBefore
+	key.NotAfter = data.NotAfter
+	if data.Secret != "" {
+		key.Secret = data.Secret
+	}
+
+	return saveSigningKey(c, &key)
+}
+
+func saveSigningKey(c *fiber.Ctx, key *types.SigningKey) error {
+	if err := engine.ValidateSigningKey(key); err != nil {
+		e := logger.Error("Invalid signing key", "Proxy ID: %d, %s", key.DiodeProxyID, err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": e.Error()})
+	}
+
+	if err := db.DB.Save(key).Error; err != nil {
+		logger.Log("error", "Failed to save signing key", fmt.Sprintf("Proxy ID: %d, key ID: %d, error: %s", key.DiodeProxyID, key.KeyID, err.Error()))
+		return c.Status(http.StatusBadRequest).SendString(err.Error())
+	}
+
+	logger.Log("trace", "Signing key saved", fmt.Sprintf("Proxy ID: %d, key ID: %d", key.DiodeProxyID, key.KeyID))
+	return c.Status(http.StatusOK).JSON(key)
+}
+
+func DeleteSigningKey(c *fiber.Ctx) error {
+	var key types.SigningKey
+	if err := db.DB.Unscoped().Delete(&key, "id = ?", c.Params("id")).Error; err != nil {
+		e := logger.Error("Failed to delete signing key", "Error from database: %s", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": e.Error()})
+	}
+
+	logger.Log("trace", "Signing key deleted", fmt.Sprintf("ID: %s", c.Params("id")))
+	return c.Status(http.StatusOK).JSON(fiber.Map{"id": c.Params("id")})
+}
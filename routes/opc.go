@@ -5,14 +5,16 @@ import (
 	"dd-opcda/engine"
 	"dd-opcda/logger"
 	"dd-opcda/types"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 
-	"github.com/cyops-se/opc"
 	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
 )
 
 func RegisterOPCRoutes(api fiber.Router) {
@@ -81,10 +83,10 @@ func GetServerRoot(c *fiber.Ctx) error {
 	}
 
 	engine.Lock()
-	opc.MoveCursorHome(browser)
-	branches := opc.CursorListBranches(browser)
-	leaves := opc.CursorListLeaves(browser)
-	position := fmt.Sprintf("root.%s", opc.CursorPosition(browser))
+	browser.MoveHome()
+	branches := browser.Branches()
+	leaves := browser.Leaves()
+	position := fmt.Sprintf("root.%s", browser.Position())
 	server, _ := engine.GetServer(sid)
 	engine.Unlock()
 
@@ -106,7 +108,7 @@ func GetServerPosition(c *fiber.Ctx) error {
 	}
 
 	engine.Lock()
-	position := opc.CursorPosition(browser)
+	position := browser.Position()
 	engine.Unlock()
 
 	c.Status(200)
@@ -132,8 +134,8 @@ func GetServerBranches(c *fiber.Ctx) (err error) {
 	}
 
 	engine.Lock()
-	opc.MoveCursorTo(browser, branch)
-	items := opc.CursorListBranches(browser)
+	browser.MoveTo(branch)
+	items := browser.Branches()
 	engine.Unlock()
 
 	c.Status(200)
@@ -157,8 +159,8 @@ func GetServerLeaves(c *fiber.Ctx) error {
 	}
 
 	engine.Lock()
-	opc.MoveCursorTo(browser, branch)
-	items := opc.CursorListLeaves(browser)
+	browser.MoveTo(branch)
+	items := browser.Leaves()
 	engine.Unlock()
 
 	c.Status(200)
@@ -182,10 +184,10 @@ func GetServerListBranches(c *fiber.Ctx) (err error) {
 	}
 
 	engine.Lock()
-	opc.MoveCursorTo(browser, branch)
-	branches := opc.CursorListBranches(browser)
-	leaves := opc.CursorListLeaves(browser)
-	position := fmt.Sprintf("root.%s", opc.CursorPosition(browser))
+	browser.MoveTo(branch)
+	branches := browser.Branches()
+	leaves := browser.Leaves()
+	position := fmt.Sprintf("root.%s", browser.Position())
 	engine.Unlock()
 
 	c.Status(200)
@@ -227,6 +229,10 @@ func NewGroup(c *fiber.Ctx) (err error) {
 		return c.Status(503).SendString(err.Error())
 	}
 
+	if err := engine.ValidateGroup(&group); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(&fiber.Map{"error": err.Error()})
+	}
+
 	if group.DefaultGroup {
 		if err := db.DB.Exec("update opc_groups set 'default_group' = false").Error; err != nil {
 			logger.Log("error", "NewGroup failed to reset default group flag", fmt.Sprintf("%v", err))
@@ -266,14 +272,36 @@ func UpdateGroup(c *fiber.Ctx) (err error) {
 	group.Description = data.Description
 	group.DefaultGroup = data.DefaultGroup
 	group.DiodeProxyID = data.DiodeProxy.ID
+	group.SourceType = data.SourceType
 	group.Interval = data.Interval
 	group.RunAtStart = data.RunAtStart
+	group.MaxSilence = data.MaxSilence
+	group.Mode = data.Mode
+	group.UpdateRate = data.UpdateRate
+	group.PercentDeadband = data.PercentDeadband
+	group.QualityPolicy = data.QualityPolicy
+	group.QualityText = data.QualityText
+	group.TimestampSource = data.TimestampSource
+	group.MaxClockSkew = data.MaxClockSkew
+	group.AlignToClock = data.AlignToClock
+	group.Schedule = data.Schedule
+	group.FrozenAfter = data.FrozenAfter
+	group.StaleAfter = data.StaleAfter
+
+	if err := engine.ValidateGroup(&group); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(&fiber.Map{"error": err.Error()})
+	}
 
 	if err := db.DB.Save(&group).Error; err != nil {
 		logger.Log("error", "UpdateGroup failed (save)", fmt.Sprintf("%v", err))
 		return c.Status(503).SendString(err.Error())
 	}
 
+	if err := db.DB.Model(&group).Association("RedundantProxies").Replace(data.RedundantProxies); err != nil {
+		logger.Log("error", "UpdateGroup failed (redundant proxies)", fmt.Sprintf("%v", err))
+		return c.Status(503).SendString(err.Error())
+	}
+
 	// return c.Status(http.StatusOK).JSON(group)
 	return GetGroups(c)
 }
@@ -343,7 +371,8 @@ func PostGroupAddTag(c *fiber.Ctx) (err error) {
 	}
 
 	var items []string
-	if err = c.BodyParser(&items); err == nil {
+	var raw []json.RawMessage
+	if err = c.BodyParser(&items); err == nil && json.Unmarshal(c.Body(), &raw) == nil && len(raw) == len(items) {
 		for _, tagname := range items {
 			var tag types.OPCTag
 			err = db.DB.Take(&tag, "name = ?", tagname).Error
@@ -392,7 +421,8 @@ func PostTagNames(c *fiber.Ctx) (err error) {
 	savedcount := 0
 	failedcount := 0
 	skippedcount := 0
-	if err = c.BodyParser(&items); err == nil {
+	var raw []json.RawMessage
+	if err = c.BodyParser(&items); err == nil && json.Unmarshal(c.Body(), &raw) == nil && len(raw) == len(items) {
 		for _, tagname := range items {
 			found := false
 			for _, name := range tagnames {
@@ -421,7 +451,8 @@ func DeleteTagNames(c *fiber.Ctx) (err error) {
 	defer handlePanic(c, "DeleteTagNames")
 
 	var items []string
-	if err = c.BodyParser(&items); err == nil {
+	var raw []json.RawMessage
+	if err = c.BodyParser(&items); err == nil && json.Unmarshal(c.Body(), &raw) == nil && len(raw) == len(items) {
 		if err = db.DB.Where("Name in ?", items).Delete(&types.OPCTag{}).Error; err != nil {
 			return c.Status(http.StatusInternalServerError).JSON(&fiber.Map{"error": err.Error()})
 		}
@@ -430,6 +461,33 @@ func DeleteTagNames(c *fiber.Ctx) (err error) {
 	return c.Status(200).JSON(&fiber.Map{"deleteitems": items})
 }
 
+// postedColumns returns the database columns of the tag fields in a posted JSON object
+func postedColumns(raw json.RawMessage) (columns []string) {
+	var posted map[string]json.RawMessage
+	if json.Unmarshal(raw, &posted) != nil {
+		return nil
+	}
+
+	keys := make(map[string]bool, len(posted))
+	for key := range posted {
+		keys[strings.ToLower(key)] = true
+	}
+
+	stmt := &gorm.Statement{DB: db.DB}
+	if stmt.Parse(&types.OPCTag{}) != nil {
+		return nil
+	}
+
+	for _, field := range stmt.Schema.Fields {
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" && keys[strings.ToLower(name)] && field.DBName != "" && !field.PrimaryKey {
+			columns = append(columns, field.DBName)
+		}
+	}
+
+	return columns
+}
+
 func PostTagChanges(c *fiber.Ctx) (err error) {
 	defer handlePanic(c, "PostTagChanges")
 
@@ -447,32 +505,89 @@ func PostTagChanges(c *fiber.Ctx) (err error) {
 	newcount := 0
 	failedcount := 0
 	updatedcount := 0
-	if err = c.BodyParser(&items); err == nil {
-		for _, item := range items {
+	var errors []string
+	var raw []json.RawMessage
+	if err = c.BodyParser(&items); err == nil && json.Unmarshal(c.Body(), &raw) == nil && len(raw) == len(items) {
+		// Calculated tags may refer to the other tags of their group, including tags in this change
+		groupnames := engine.GroupTagNames()
+		groups := make([]uint, len(items))
+		for i, item := range items {
+			groups[i] = item.GroupID
+			for gid, names := range groupnames {
+				if _, ok := names[item.Name]; ok && groups[i] == 0 {
+					groups[i] = gid
+				}
+			}
+			if groups[i] == 0 {
+				groups[i] = defaultgroup.ID
+			}
+		}
+		for i, item := range items {
+			// A tag moved to another group is no longer in its old one
+			for gid, names := range groupnames {
+				if gid != groups[i] {
+					delete(names, item.Name)
+				}
+			}
+			if groupnames[groups[i]] == nil {
+				groupnames[groups[i]] = map[string]bool{}
+			}
+			groupnames[groups[i]][item.Name] = item.Expression != ""
+		}
+
+		for i, item := range items {
+			// Existing tags only change the posted fields, the others keep their stored values
+			var columns []string
 			found := false
 			for _, name := range tagnames {
-				if item.Name == name {
-					if err = db.DB.Save(&item).Error; err == nil {
-						found = true
-						updatedcount++
-						break
+				if item.Name != name {
+					continue
+				}
+
+				var existing types.OPCTag
+				if err = db.DB.Take(&existing, "name = ?", item.Name).Error; err == nil {
+					columns = postedColumns(raw[i])
+					item = existing
+					json.Unmarshal(raw[i], &item)
+					if item.GroupID == 0 {
+						item.GroupID = existing.GroupID
 					}
+					found = true
 				}
+				break
 			}
 
-			if !found {
-				if item.GroupID == 0 {
-					item.GroupID = defaultgroup.ID
-				}
+			if err = engine.ValidateTag(&item); err == nil && item.Expression != "" {
+				err = engine.ValidateExpression(&item, groupnames[groups[i]])
+			}
+			if err != nil {
+				errors = append(errors, err.Error())
+				failedcount++
+				continue
+			}
 
-				if err = db.DB.Create(&item).Error; err == nil {
-					newcount++
+			if found {
+				if len(columns) == 0 {
+					updatedcount++
+				} else if err = db.DB.Model(&item).Select(columns).Updates(&item).Error; err == nil {
+					updatedcount++
 				} else {
 					failedcount++
 				}
+				continue
+			}
+
+			if item.GroupID == 0 {
+				item.GroupID = defaultgroup.ID
+			}
+
+			if err = db.DB.Create(&item).Error; err == nil {
+				newcount++
+			} else {
+				failedcount++
 			}
 		}
 	}
 
-	return c.Status(200).JSON(&fiber.Map{"new": newcount, "updated": updatedcount, "failed": failedcount, "total": len(items)})
+	return c.Status(200).JSON(&fiber.Map{"new": newcount, "updated": updatedcount, "failed": failedcount, "total": len(items), "errors": errors})
 }
@@ -0,0 +1,42 @@
+// +build !windows
+
+package main
+
+import (
+	"dd-opcda/logger"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func handlePanic() {
+	if r := recover(); r != nil {
+		log.Printf("Service panic, recovery: %#v", r)
+		return
+	}
+}
+
+func isWindowsService() (bool, error) {
+	return false, nil
+}
+
+func installService(name, desc string) error {
+	return fmt.Errorf("services can only be installed on Windows")
+}
+
+func removeService(name string) error {
+	return fmt.Errorf("services can only be removed on Windows")
+}
+
+func runService(name string, isDebug bool) {
+	logger.Trace("Service info", "starting %s", name)
+	go runEngine()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+
+	logger.Trace("Service info", "%s stopped", name)
+}
@@ -27,6 +27,10 @@ func handlePanic() {
 	}
 }
 
+func isWindowsService() (bool, error) {
+	return svc.IsWindowsService()
+}
+
 func reportError(f string, args ...interface{}) {
 	msg := fmt.Sprintf(f, args...)
 	logger.Error("Windows service error", msg)
@@ -0,0 +1,97 @@
+package sign
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// MinSecretSize is the min number of bytes of a key secret
+const MinSecretSize = 16
+
+// Key is a signing key valid from NotBefore until NotAfter. Zero times leave the
+// validity open
+type Key struct {
+	ID        uint16
+	Secret    []byte
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+// Keyring holds the keys of a stream. Keys are rotated by adding a new key that becomes
+// valid before the old key expires: the sender signs with the key that became valid
+// last, while the receiver accepts both until the old key expires
+type Keyring struct {
+	mutex sync.RWMutex
+	keys  []Key
+}
+
+// ParseKey returns a key with a hex encoded secret
+func ParseKey(id uint16, secret string, notBefore time.Time, notAfter time.Time) (Key, error) {
+	data, err := hex.DecodeString(secret)
+	if err != nil {
+		return Key{}, fmt.Errorf("key %d secret is not hex encoded: %s", id, err.Error())
+	}
+
+	if len(data) < MinSecretSize {
+		return Key{}, fmt.Errorf("key %d secret is %d bytes, at least %d bytes required", id, len(data), MinSecretSize)
+	}
+
+	return Key{ID: id, Secret: data, NotBefore: notBefore, NotAfter: notAfter}, nil
+}
+
+// Valid returns true if the key is valid at t
+func (k Key) Valid(t time.Time) bool {
+	return (k.NotBefore.IsZero() || !t.Before(k.NotBefore)) && (k.NotAfter.IsZero() || t.Before(k.NotAfter))
+}
+
+// NewKeyring returns a keyring holding the keys
+func NewKeyring(keys ...Key) *Keyring {
+	r := &Keyring{}
+	r.Set(keys)
+	return r
+}
+
+// Set replaces the keys of the keyring
+func (r *Keyring) Set(keys []Key) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.keys = append([]Key(nil), keys...)
+}
+
+// Len returns the number of keys, valid or not
+func (r *Keyring) Len() int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return len(r.keys)
+}
+
+// Signing returns the key to sign with at t, which is the valid key that became valid
+// last, and false if no key is valid
+func (r *Keyring) Signing(t time.Time) (key Key, ok bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	for _, k := range r.keys {
+		if k.Valid(t) && (!ok || k.NotBefore.After(key.NotBefore) || (k.NotBefore.Equal(key.NotBefore) && k.ID > key.ID)) {
+			key, ok = k, true
+		}
+	}
+
+	return key, ok
+}
+
+// Key returns the key with the ID if it is valid at t
+func (r *Keyring) Key(id uint16, t time.Time) (Key, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	for _, k := range r.keys {
+		if k.ID == id && k.Valid(t) {
+			return k, true
+		}
+	}
+
+	return Key{}, false
+}
@@ -0,0 +1,107 @@
+package sign
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// Signed packets carry a header, the payload and an HMAC-SHA256 of the header and
+// payload. The header is:
+//
+//	magic      byte, Magic
+//	key ID     uint16 big endian, the key the packet is signed with
+//	timestamp  int64 big endian, milliseconds since the Unix epoch when it was signed
+//
+// The MAC covers the timestamp, so receivers can reject packets replayed later than
+// the max age of the verifier.
+const (
+	Magic      = 0xA5
+	HeaderSize = 11
+	MACSize    = sha256.Size
+	Overhead   = HeaderSize + MACSize
+)
+
+// Defaults of verifiers that do not set MaxAge or Grace
+const (
+	DefaultMaxAge = 30 * time.Second
+	DefaultGrace  = 5 * time.Second
+)
+
+var (
+	ErrNotSigned  = errors.New("packet is not signed")
+	ErrUnknownKey = errors.New("packet is signed with an unknown or expired key")
+	ErrBadMAC     = errors.New("packet MAC does not match")
+	ErrTooOld     = errors.New("packet timestamp is outside the max age")
+)
+
+// Sign returns the payload signed with the key at time now
+func Sign(payload []byte, key Key, now time.Time) []byte {
+	packet := make([]byte, HeaderSize+len(payload), Overhead+len(payload))
+	packet[0] = Magic
+	binary.BigEndian.PutUint16(packet[1:3], key.ID)
+	binary.BigEndian.PutUint64(packet[3:11], uint64(now.UnixNano()/int64(time.Millisecond)))
+	copy(packet[HeaderSize:], payload)
+
+	return append(packet, mac(key.Secret, packet)...)
+}
+
+// Verifier checks signed packets against a keyring. The timestamp of a packet is only
+// trusted within MaxAge of the receive time, which is the window packets can be
+// replayed in, and keys are expired by the receive time, not the packet timestamp
+type Verifier struct {
+	Keyring *Keyring
+	MaxAge  time.Duration // Max difference between the packet timestamp and now, 0 = DefaultMaxAge
+	Grace   time.Duration // How long packets signed with a key are accepted after its NotAfter, 0 = DefaultGrace
+}
+
+// Verify returns the payload of a packet received at now with a valid MAC and a
+// timestamp within the max age, signed with a key of the keyring that was valid when
+// the packet was signed and that has not expired at now, with the grace period
+func (v *Verifier) Verify(packet []byte, now time.Time) ([]byte, error) {
+	if len(packet) < Overhead || packet[0] != Magic {
+		return nil, ErrNotSigned
+	}
+
+	id := binary.BigEndian.Uint16(packet[1:3])
+	signed := time.Unix(0, int64(binary.BigEndian.Uint64(packet[3:11]))*int64(time.Millisecond))
+	key, ok := v.Keyring.Key(id, signed)
+	if !ok || (!key.NotAfter.IsZero() && !now.Before(key.NotAfter.Add(v.grace()))) {
+		return nil, ErrUnknownKey
+	}
+
+	body := packet[:len(packet)-MACSize]
+	if !hmac.Equal(mac(key.Secret, body), packet[len(packet)-MACSize:]) {
+		return nil, ErrBadMAC
+	}
+
+	if age := now.Sub(signed); age > v.maxAge() || age < -v.maxAge() {
+		return nil, ErrTooOld
+	}
+
+	return body[HeaderSize:], nil
+}
+
+func (v *Verifier) maxAge() time.Duration {
+	if v.MaxAge > 0 {
+		return v.MaxAge
+	}
+
+	return DefaultMaxAge
+}
+
+func (v *Verifier) grace() time.Duration {
+	if v.Grace > 0 {
+		return v.Grace
+	}
+
+	return DefaultGrace
+}
+
+func mac(secret []byte, data []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write(data)
+	return h.Sum(nil)
+}
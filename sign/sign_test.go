@@ -0,0 +1,202 @@
+package sign
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+var signTime = time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+
+func testKey(t *testing.T, id uint16, fill string, notBefore time.Time, notAfter time.Time) Key {
+	key, err := ParseKey(id, strings.Repeat(fill, 32), notBefore, notAfter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func TestRoundTrip(t *testing.T) {
+	key := testKey(t, 1, "a", time.Time{}, time.Time{})
+	v := &Verifier{Keyring: NewKeyring(key)}
+
+	for _, payload := range [][]byte{{}, []byte(`{"version":2}`), bytes.Repeat([]byte{0xFE, 0}, 700)} {
+		packet := Sign(payload, key, signTime)
+		if len(packet) != len(payload)+Overhead {
+			t.Errorf("signed packet is %d bytes, want %d", len(packet), len(payload)+Overhead)
+		}
+
+		got, err := v.Verify(packet, signTime.Add(time.Second))
+		if err != nil {
+			t.Fatalf("verify failed: %s", err)
+		}
+		if !bytes.Equal(got, payload) {
+			t.Errorf("verified payload differs from the signed payload")
+		}
+	}
+}
+
+func TestTampered(t *testing.T) {
+	key := testKey(t, 1, "a", time.Time{}, time.Time{})
+	v := &Verifier{Keyring: NewKeyring(key)}
+	packet := Sign([]byte("payload"), key, signTime)
+
+	tests := []struct {
+		name  string
+		index int
+		err   error
+	}{
+		{"magic", 0, ErrNotSigned},
+		{"timestamp", 8, ErrBadMAC},
+		{"payload", HeaderSize + 2, ErrBadMAC},
+		{"MAC", len(packet) - 1, ErrBadMAC},
+	}
+
+	for _, test := range tests {
+		tampered := append([]byte(nil), packet...)
+		tampered[test.index] ^= 0x01
+		if _, err := v.Verify(tampered, signTime); err != test.err {
+			t.Errorf("%s tampered: err %v, want %v", test.name, err, test.err)
+		}
+	}
+
+	if _, err := v.Verify(packet[:len(packet)-1], signTime); err != ErrBadMAC {
+		t.Errorf("truncated: err %v, want %v", err, ErrBadMAC)
+	}
+	if _, err := v.Verify(packet[:Overhead-1], signTime); err != ErrNotSigned {
+		t.Errorf("short: err %v, want %v", err, ErrNotSigned)
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	key := testKey(t, 1, "a", time.Time{}, time.Time{})
+	other := testKey(t, 1, "b", time.Time{}, time.Time{})
+	unknown := testKey(t, 2, "a", time.Time{}, time.Time{})
+	v := &Verifier{Keyring: NewKeyring(key)}
+
+	if _, err := v.Verify(Sign([]byte("payload"), other, signTime), signTime); err != ErrBadMAC {
+		t.Errorf("other secret: err %v, want %v", err, ErrBadMAC)
+	}
+	if _, err := v.Verify(Sign([]byte("payload"), unknown, signTime), signTime); err != ErrUnknownKey {
+		t.Errorf("unknown key ID: err %v, want %v", err, ErrUnknownKey)
+	}
+}
+
+func TestRotation(t *testing.T) {
+	// The new key becomes valid an hour before the old key expires
+	older := testKey(t, 1, "a", time.Time{}, signTime.Add(time.Hour))
+	newer := testKey(t, 2, "b", signTime, time.Time{})
+	r := NewKeyring(older, newer)
+	v := &Verifier{Keyring: r}
+
+	tests := []struct {
+		name   string
+		now    time.Time
+		signer uint16
+	}{
+		{"before overlap", signTime.Add(-time.Minute), 1},
+		{"overlap", signTime.Add(time.Minute), 2},
+		{"after overlap", signTime.Add(2 * time.Hour), 2},
+	}
+
+	for _, test := range tests {
+		key, ok := r.Signing(test.now)
+		if !ok || key.ID != test.signer {
+			t.Errorf("%s: signing with key %d (%v), want %d", test.name, key.ID, ok, test.signer)
+		}
+	}
+
+	// During the overlap, packets signed with either key are accepted
+	now := signTime.Add(time.Minute)
+	for _, key := range []Key{older, newer} {
+		if _, err := v.Verify(Sign([]byte("payload"), key, now), now); err != nil {
+			t.Errorf("key %d during overlap: %s", key.ID, err)
+		}
+	}
+
+	// The new key was not valid yet when this packet was signed
+	early := signTime.Add(-time.Second)
+	if _, err := v.Verify(Sign([]byte("payload"), newer, early), early); err != ErrUnknownKey {
+		t.Errorf("key %d before its notbefore: err %v, want %v", newer.ID, err, ErrUnknownKey)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	expiry := signTime.Add(time.Hour)
+	key := testKey(t, 1, "a", time.Time{}, expiry)
+	signed := expiry.Add(-time.Second)
+	packet := Sign([]byte("payload"), key, signed)
+
+	tests := []struct {
+		name  string
+		grace time.Duration
+		now   time.Time
+		err   error
+	}{
+		{"before expiry", 0, expiry.Add(-time.Millisecond), nil},
+		{"within default grace", 0, expiry.Add(DefaultGrace - time.Millisecond), nil},
+		{"after default grace", 0, expiry.Add(DefaultGrace), ErrUnknownKey},
+		{"within grace", 20 * time.Second, expiry.Add(19 * time.Second), nil},
+		{"after grace", 20 * time.Second, expiry.Add(20 * time.Second), ErrUnknownKey},
+	}
+
+	for _, test := range tests {
+		v := &Verifier{Keyring: NewKeyring(key), Grace: test.grace}
+		if _, err := v.Verify(packet, test.now); err != test.err {
+			t.Errorf("%s: err %v, want %v", test.name, err, test.err)
+		}
+	}
+
+	// A packet claiming to be signed before expiry is rejected when received long after,
+	// even with a max age that would accept it
+	v := &Verifier{Keyring: NewKeyring(key), MaxAge: 24 * time.Hour}
+	if _, err := v.Verify(packet, expiry.Add(time.Hour)); err != ErrUnknownKey {
+		t.Errorf("received after expiry: err %v, want %v", err, ErrUnknownKey)
+	}
+}
+
+func TestMaxAge(t *testing.T) {
+	key := testKey(t, 1, "a", time.Time{}, time.Time{})
+	packet := Sign([]byte("payload"), key, signTime)
+
+	tests := []struct {
+		name   string
+		maxAge time.Duration
+		now    time.Time
+		err    error
+	}{
+		{"within default", 0, signTime.Add(DefaultMaxAge), nil},
+		{"replayed after default", 0, signTime.Add(DefaultMaxAge + time.Millisecond), ErrTooOld},
+		{"from the future", 0, signTime.Add(-DefaultMaxAge - time.Millisecond), ErrTooOld},
+		{"within max age", time.Minute, signTime.Add(time.Minute), nil},
+		{"replayed after max age", time.Minute, signTime.Add(time.Minute + time.Millisecond), ErrTooOld},
+	}
+
+	for _, test := range tests {
+		v := &Verifier{Keyring: NewKeyring(key), MaxAge: test.maxAge}
+		if _, err := v.Verify(packet, test.now); err != test.err {
+			t.Errorf("%s: err %v, want %v", test.name, err, test.err)
+		}
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret string
+		ok     bool
+	}{
+		{"32 bytes", strings.Repeat("ab", 32), true},
+		{"16 bytes", strings.Repeat("ab", MinSecretSize), true},
+		{"too short", strings.Repeat("ab", MinSecretSize-1), false},
+		{"not hex", strings.Repeat("xy", 32), false},
+	}
+
+	for _, test := range tests {
+		if _, err := ParseKey(1, test.secret, time.Time{}, time.Time{}); (err == nil) != test.ok {
+			t.Errorf("%s: err %v", test.name, err)
+		}
+	}
+}
@@ -0,0 +1,536 @@
+package types
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Binary data messages start with a magic and the binary format version, so receivers
+// can tell them from JSON messages, which start with '{'. Then follows:
+//
+//	sequence, interval     uvarint, the interval in milliseconds
+//	group                  string (uvarint length and UTF-8 bytes)
+//	count                  uvarint
+//	base time              varint seconds and uvarint nanoseconds since the Unix epoch
+//	points                 count times:
+//	  fields               byte, binaryPoint* bits
+//	  id                   uvarint tag ID, names are sent on the meta channel
+//	  name                 string, only for points without an ID
+//	  time                 varint nanoseconds since the previous time, unless zero
+//	  quality, flags       uvarint
+//	  quality text         string, if present
+//	  receive time         varint nanoseconds since the previous time, if present
+//	  value                byte data type, see binaryTypes, and the value
+//
+// Values are as encoded by EncodeValue: signed integers are zig-zag varints, unsigned
+// integers uvarints, floats IEEE 754 little endian, bool a byte, time varint seconds
+// and uvarint nanoseconds, and strings and decimals strings. The data type of an array
+// has binaryArray set and is followed by the uvarint element count and the elements,
+// each with its own data type byte if the array is variant[]. Values without a data
+// type are sent as their JSON text
+const (
+	BinaryMagic   = 0xDD
+	BinaryVersion = 1
+)
+
+const (
+	binaryPointName = 1 << iota
+	binaryPointQualityText
+	binaryPointReceived
+	binaryPointZeroTime
+)
+
+const (
+	binaryArray    = 0x80
+	binaryUntyped  = 0x7F
+	binaryMaxNulls = 1 << 16 // Max elements of a null[] array
+)
+
+// binaryTypes is indexed by the data type byte
+var binaryTypes = []string{
+	ValueNull, ValueBool,
+	ValueInt8, ValueInt16, ValueInt32, ValueInt64,
+	ValueUint8, ValueUint16, ValueUint32, ValueUint64,
+	ValueFloat32, ValueFloat64,
+	ValueString, ValueTime, ValueDecimal, ValueVariant,
+}
+
+type binaryWriter struct {
+	bytes.Buffer
+	scratch [binary.MaxVarintLen64]byte
+}
+
+type binaryReader struct {
+	*bytes.Reader
+	err error
+}
+
+// MarshalBinary encodes the message in the compact binary format
+func (m *DataMessage) MarshalBinary() ([]byte, error) {
+	var base time.Time
+	for _, p := range m.Points {
+		if !p.Time.IsZero() {
+			base = p.Time
+			break
+		}
+	}
+
+	w := &binaryWriter{}
+	w.header(m, len(m.Points), base)
+	previous := base
+	for _, p := range m.Points {
+		var err error
+		if previous, err = w.point(p, previous); err != nil {
+			return nil, err
+		}
+	}
+
+	return w.Bytes(), nil
+}
+
+// BinaryHeaderSize returns the number of bytes before the points of a binary message
+// with count points, where base is the time of the first point with a time
+func (m *DataMessage) BinaryHeaderSize(count int, base time.Time) int {
+	w := &binaryWriter{}
+	w.header(m, count, base)
+	return w.Len()
+}
+
+// BinaryPointSize returns the number of bytes a point takes in a binary message when
+// the previous point's time is previous, or the base time for the first point
+func BinaryPointSize(p DataPoint, previous time.Time) int {
+	w := &binaryWriter{}
+	w.point(p, previous)
+	return w.Len()
+}
+
+func (w *binaryWriter) header(m *DataMessage, count int, base time.Time) {
+	w.WriteByte(BinaryMagic)
+	w.WriteByte(BinaryVersion)
+	w.uvarint(m.Sequence)
+	w.uvarint(uint64(m.IntervalMs))
+	w.text(m.Group)
+	w.uvarint(uint64(count))
+	w.time(base)
+}
+
+// point writes a point and returns the time the next point's time is relative to
+func (w *binaryWriter) point(p DataPoint, previous time.Time) (time.Time, error) {
+	fields := byte(0)
+	if p.ID == 0 {
+		fields |= binaryPointName
+	}
+	if p.QualityText != "" {
+		fields |= binaryPointQualityText
+	}
+	if p.Received != nil {
+		fields |= binaryPointReceived
+	}
+	if p.Time.IsZero() {
+		fields |= binaryPointZeroTime
+	}
+
+	w.WriteByte(fields)
+	w.uvarint(uint64(p.ID))
+	if fields&binaryPointName != 0 {
+		w.text(p.Name)
+	}
+	if fields&binaryPointZeroTime == 0 {
+		w.varint(int64(p.Time.Sub(previous)))
+		previous = p.Time
+	}
+	w.uvarint(uint64(p.Quality))
+	w.uvarint(uint64(p.Flags))
+	if fields&binaryPointQualityText != 0 {
+		w.text(p.QualityText)
+	}
+	if fields&binaryPointReceived != 0 {
+		w.varint(int64(p.Received.Sub(previous)))
+	}
+
+	if err := w.value(p.Value, p.Type); err != nil {
+		return previous, fmt.Errorf("point %d '%s': %s", p.ID, p.Name, err.Error())
+	}
+
+	return previous, nil
+}
+
+// UnmarshalBinary decodes a message in the compact binary format. Points are decoded
+// as version 2 points, with values encoded as by EncodeValue and no names for points
+// with an ID
+func (m *DataMessage) UnmarshalBinary(data []byte) error {
+	r := &binaryReader{Reader: bytes.NewReader(data)}
+	if magic, version := r.byte(), r.byte(); magic != BinaryMagic || version != BinaryVersion {
+		return fmt.Errorf("not a version %d binary data message", BinaryVersion)
+	}
+
+	*m = DataMessage{Version: 2}
+	m.Sequence = r.uvarint()
+	m.IntervalMs = int(r.uvarint())
+	m.Interval = m.IntervalMs / 1000
+	m.Group = r.text()
+	m.Count = int(r.uvarint())
+	if r.err == nil && (m.Count < 0 || m.Count > len(data)) {
+		return fmt.Errorf("invalid point count %d", m.Count)
+	}
+
+	previous := r.time()
+	m.Points = make([]DataPoint, 0, m.Count)
+	for i := 0; i < m.Count && r.err == nil; i++ {
+		var p DataPoint
+		fields := r.byte()
+		p.ID = int(r.uvarint())
+		if fields&binaryPointName != 0 {
+			p.Name = r.text()
+		}
+		if fields&binaryPointZeroTime == 0 {
+			p.Time = previous.Add(time.Duration(r.varint()))
+			previous = p.Time
+		}
+		p.Quality = int(r.uvarint())
+		p.Flags = int(r.uvarint())
+		if fields&binaryPointQualityText != 0 {
+			p.QualityText = r.text()
+		}
+		if fields&binaryPointReceived != 0 {
+			received := previous.Add(time.Duration(r.varint()))
+			p.Received = &received
+		}
+
+		p.Value, p.Type = r.value(r.byte())
+		m.Points = append(m.Points, p)
+	}
+
+	if r.err != nil {
+		return fmt.Errorf("invalid binary data message: %s", r.err.Error())
+	}
+
+	return nil
+}
+
+func (w *binaryWriter) uvarint(v uint64) {
+	n := binary.PutUvarint(w.scratch[:], v)
+	w.Write(w.scratch[:n])
+}
+
+func (w *binaryWriter) varint(v int64) {
+	n := binary.PutVarint(w.scratch[:], v)
+	w.Write(w.scratch[:n])
+}
+
+func (w *binaryWriter) text(s string) {
+	w.uvarint(uint64(len(s)))
+	w.WriteString(s)
+}
+
+func (w *binaryWriter) time(t time.Time) {
+	w.varint(t.Unix())
+	w.uvarint(uint64(t.Nanosecond()))
+}
+
+// value writes the data type byte and an encoded value
+func (w *binaryWriter) value(v interface{}, dtype string) error {
+	code := binaryTypeCode(dtype)
+	w.WriteByte(code)
+	if code == binaryUntyped {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		w.text(string(data))
+		return nil
+	}
+
+	if code&binaryArray == 0 {
+		return w.scalar(v, dtype)
+	}
+
+	var elements []interface{}
+	switch items := v.(type) {
+	case []interface{}:
+		elements = items
+	case nil:
+	default:
+		return fmt.Errorf("%s value is not an array", dtype)
+	}
+
+	element := binaryTypes[code&^binaryArray]
+	w.uvarint(uint64(len(elements)))
+	for _, item := range elements {
+		if element != ValueVariant {
+			if err := w.scalar(item, element); err != nil {
+				return err
+			}
+			continue
+		}
+
+		variant, ok := item.(VariantElement)
+		if decoded, isobject := item.(map[string]interface{}); isobject {
+			// Element of a message decoded from JSON
+			variant.Type, ok = decoded["dt"].(string)
+			variant.Value = decoded["v"]
+		}
+		if !ok {
+			return fmt.Errorf("variant array element is not a VariantElement")
+		}
+		if err := w.value(variant.Value, variant.Type); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *binaryWriter) scalar(v interface{}, dtype string) error {
+	text, _ := v.(string)
+	switch dtype {
+	case ValueNull:
+	case ValueBool:
+		b, _ := v.(bool)
+		if b {
+			w.WriteByte(1)
+		} else {
+			w.WriteByte(0)
+		}
+	case ValueInt8, ValueInt16, ValueInt32:
+		n, _ := toInt64(v)
+		w.varint(n)
+	case ValueUint8, ValueUint16, ValueUint32:
+		n, _ := toInt64(v)
+		w.uvarint(uint64(n))
+	case ValueInt64:
+		n, err := strconv.ParseInt(text, 10, 64)
+		if err != nil {
+			return err
+		}
+		w.varint(n)
+	case ValueUint64:
+		n, err := strconv.ParseUint(text, 10, 64)
+		if err != nil {
+			return err
+		}
+		w.uvarint(n)
+	case ValueFloat32:
+		f, ok := v.(float32)
+		if !ok {
+			decoded, _ := v.(float64) // Float32 values decoded from JSON
+			f = float32(decoded)
+		}
+		binary.LittleEndian.PutUint32(w.scratch[:4], math.Float32bits(f))
+		w.Write(w.scratch[:4])
+	case ValueFloat64:
+		f, _ := v.(float64)
+		binary.LittleEndian.PutUint64(w.scratch[:8], math.Float64bits(f))
+		w.Write(w.scratch[:8])
+	case ValueTime:
+		t, err := time.Parse(time.RFC3339Nano, text)
+		if err != nil {
+			return err
+		}
+		w.time(t)
+	case ValueString, ValueDecimal:
+		w.text(text)
+	default:
+		return fmt.Errorf("unknown data type '%s'", dtype)
+	}
+
+	return nil
+}
+
+func binaryTypeCode(dtype string) byte {
+	array := byte(0)
+	if len(dtype) > len(ValueArray) && dtype[len(dtype)-len(ValueArray):] == ValueArray {
+		array = binaryArray
+		dtype = dtype[:len(dtype)-len(ValueArray)]
+	}
+
+	for i, t := range binaryTypes {
+		if t == dtype && (t != ValueVariant || array != 0) {
+			return byte(i) | array
+		}
+	}
+
+	return binaryUntyped
+}
+
+// toInt64 converts the integer values EncodeValue sends as JSON numbers
+func toInt64(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int8:
+		return int64(n), true
+	case int16:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case uint8:
+		return int64(n), true
+	case uint16:
+		return int64(n), true
+	case uint32:
+		return int64(n), true
+	case int:
+		return int64(n), true
+	case float64:
+		return int64(n), true
+	}
+
+	return 0, false
+}
+
+func (r *binaryReader) byte() byte {
+	if r.err != nil {
+		return 0
+	}
+
+	var b byte
+	b, r.err = r.ReadByte()
+	return b
+}
+
+func (r *binaryReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+
+	var v uint64
+	v, r.err = binary.ReadUvarint(r)
+	return v
+}
+
+func (r *binaryReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+
+	var v int64
+	v, r.err = binary.ReadVarint(r)
+	return v
+}
+
+func (r *binaryReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+
+	if n < 0 || n > r.Len() {
+		r.err = fmt.Errorf("length %d beyond end of message", n)
+		return nil
+	}
+
+	data := make([]byte, n)
+	r.Read(data)
+	return data
+}
+
+func (r *binaryReader) text() string {
+	return string(r.bytes(int(r.uvarint())))
+}
+
+func (r *binaryReader) time() time.Time {
+	seconds := r.varint()
+	nanoseconds := r.uvarint()
+	return time.Unix(seconds, int64(nanoseconds)).UTC()
+}
+
+// value reads a value of the data type code, encoded as by EncodeValue
+func (r *binaryReader) value(code byte) (interface{}, string) {
+	if code == binaryUntyped {
+		var v interface{}
+		if data := r.text(); r.err == nil {
+			r.err = json.Unmarshal([]byte(data), &v)
+		}
+		return v, ""
+	}
+
+	if int(code&^binaryArray) >= len(binaryTypes) {
+		if r.err == nil {
+			r.err = fmt.Errorf("unknown data type %d", code)
+		}
+		return nil, ""
+	}
+
+	dtype := binaryTypes[code&^binaryArray]
+	if code&binaryArray == 0 {
+		return r.scalar(dtype), dtype
+	}
+
+	// The count is bounded by the bytes left, or by a fixed cap for null elements, which
+	// take no bytes, so a corrupt count does not allocate a huge array
+	count := int(r.uvarint())
+	size := binaryMinSize(dtype)
+	if count < 0 || (size == 0 && count > binaryMaxNulls) || (size > 0 && count > r.Len()/size) {
+		r.err = fmt.Errorf("invalid array length %d", count)
+		return nil, ""
+	}
+
+	elements := make([]interface{}, 0, count)
+	for i := 0; i < count && r.err == nil; i++ {
+		if dtype == ValueVariant {
+			v, t := r.value(r.byte())
+			elements = append(elements, VariantElement{Type: t, Value: v})
+		} else {
+			elements = append(elements, r.scalar(dtype))
+		}
+	}
+
+	return elements, dtype + ValueArray
+}
+
+// binaryMinSize returns the fewest bytes an array element of the data type is encoded
+// in, a data type byte for variant elements
+func binaryMinSize(dtype string) int {
+	switch dtype {
+	case ValueNull:
+		return 0
+	case ValueTime:
+		return 2
+	case ValueFloat32:
+		return 4
+	case ValueFloat64:
+		return 8
+	}
+
+	return 1
+}
+
+func (r *binaryReader) scalar(dtype string) interface{} {
+	switch dtype {
+	case ValueBool:
+		return r.byte() != 0
+	case ValueInt8:
+		return int8(r.varint())
+	case ValueInt16:
+		return int16(r.varint())
+	case ValueInt32:
+		return int32(r.varint())
+	case ValueInt64:
+		return strconv.FormatInt(r.varint(), 10)
+	case ValueUint8:
+		return uint8(r.uvarint())
+	case ValueUint16:
+		return uint16(r.uvarint())
+	case ValueUint32:
+		return uint32(r.uvarint())
+	case ValueUint64:
+		return strconv.FormatUint(r.uvarint(), 10)
+	case ValueFloat32:
+		if data := r.bytes(4); data != nil {
+			return math.Float32frombits(binary.LittleEndian.Uint32(data))
+		}
+	case ValueFloat64:
+		if data := r.bytes(8); data != nil {
+			return math.Float64frombits(binary.LittleEndian.Uint64(data))
+		}
+	case ValueTime:
+		return r.time().Format(time.RFC3339Nano)
+	case ValueString, ValueDecimal:
+		return r.text()
+	}
+
+	return nil
+}
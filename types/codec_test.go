@@ -0,0 +1,312 @@
+package types
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var codecTime = time.Date(2026, 10, 18, 12, 30, 15, 123456789, time.UTC)
+
+// codecValues are values of every data type, with the values a receiver decodes
+var codecValues = []struct {
+	name  string
+	value interface{}
+	dtype string
+	want  interface{}
+}{
+	{"null", nil, ValueNull, nil},
+	{"bool", true, ValueBool, true},
+	{"int8", int8(math.MinInt8), ValueInt8, int8(math.MinInt8)},
+	{"int16", int16(math.MaxInt16), ValueInt16, int16(math.MaxInt16)},
+	{"int32", int32(math.MinInt32), ValueInt32, int32(math.MinInt32)},
+	{"int64", int64(math.MinInt64), ValueInt64, int64(math.MinInt64)},
+	{"int", 42, ValueInt64, int64(42)},
+	{"uint8", uint8(math.MaxUint8), ValueUint8, uint8(math.MaxUint8)},
+	{"uint16", uint16(math.MaxUint16), ValueUint16, uint16(math.MaxUint16)},
+	{"uint32", uint32(math.MaxUint32), ValueUint32, uint32(math.MaxUint32)},
+	{"uint64", uint64(math.MaxUint64), ValueUint64, uint64(math.MaxUint64)},
+	{"float32", float32(0.1), ValueFloat32, float32(0.1)},
+	{"float64", -math.MaxFloat64, ValueFloat64, -math.MaxFloat64},
+	{"string", "zürich \"quoted\"", ValueString, "zürich \"quoted\""},
+	{"empty string", "", ValueString, ""},
+	{"time", codecTime.In(time.FixedZone("CET", 3600)), ValueTime, codecTime},
+	{"decimal", Decimal{Unscaled: big.NewInt(-1234567891), Scale: 4}, ValueDecimal, "-123456.7891"},
+	{"big decimal", Decimal{Unscaled: new(big.Int).Lsh(big.NewInt(1), 96), Scale: 10}, ValueDecimal, "7922816251426433759.3543950336"},
+	{"bool array", []bool{true, false}, ValueBool + ValueArray, []interface{}{true, false}},
+	{"int32 array", []int32{1, -2, math.MaxInt32}, ValueInt32 + ValueArray, []interface{}{int32(1), int32(-2), int32(math.MaxInt32)}},
+	{"uint64 array", []uint64{0, math.MaxUint64}, ValueUint64 + ValueArray, []interface{}{uint64(0), uint64(math.MaxUint64)}},
+	{"float64 array", []float64{1.5, math.SmallestNonzeroFloat64}, ValueFloat64 + ValueArray, []interface{}{1.5, math.SmallestNonzeroFloat64}},
+	{"string array", []string{"a", ""}, ValueString + ValueArray, []interface{}{"a", ""}},
+	{"time array", []time.Time{codecTime, {}}, ValueTime + ValueArray, []interface{}{codecTime, time.Time{}.UTC()}},
+	{"decimal array", []Decimal{{Unscaled: big.NewInt(5), Scale: 1}}, ValueDecimal + ValueArray, []interface{}{"0.5"}},
+	{"empty array", []int16{}, ValueVariant + ValueArray, []interface{}{}},
+	{"null array", make([]interface{}, 30), ValueNull + ValueArray, make([]interface{}, 30)},
+	{"variant array", []interface{}{int8(-1), "x", nil, uint64(7), Decimal{Unscaled: big.NewInt(1), Scale: 2}, []interface{}{true}}, ValueVariant + ValueArray,
+		[]interface{}{int8(-1), "x", nil, uint64(7), "0.01", []interface{}{true}}},
+}
+
+// normalize replaces decimals and times with their text so decoded values compare
+func normalize(v interface{}) interface{} {
+	switch value := v.(type) {
+	case Decimal:
+		return value.String()
+	case time.Time:
+		return value.UTC().Format(time.RFC3339Nano)
+	case []interface{}:
+		values := make([]interface{}, len(value))
+		for i := range value {
+			values[i] = normalize(value[i])
+		}
+		return values
+	}
+
+	return v
+}
+
+// codecMessage returns a message with a point of each value, alternating points with
+// and without IDs, times, quality texts and receive times
+func codecMessage() *DataMessage {
+	msg := &DataMessage{Version: 2, Group: "codec", Interval: 1, IntervalMs: 1500, Sequence: math.MaxUint64}
+	for i, test := range codecValues {
+		p := DataPoint{ID: i, Name: test.name, Quality: 0xC0 - i, Flags: i % 4}
+		p.Value, p.Type = EncodeValue(test.value)
+		if i%3 != 1 {
+			p.Time = codecTime.Add(time.Duration(i-5) * 997 * time.Millisecond)
+		}
+		if i%2 == 0 {
+			p.QualityText = DecodeQuality(p.Quality).String()
+		}
+		if i%4 != 3 {
+			received := codecTime.Add(time.Duration(i) * time.Second)
+			p.Received = &received
+		}
+		msg.Points = append(msg.Points, p)
+	}
+	msg.Count = len(msg.Points)
+
+	return msg
+}
+
+// codecRoundTrip returns the message as decoded from JSON and from the binary format
+func codecRoundTrip(t *testing.T, msg *DataMessage) (fromJSON *DataMessage, fromBinary *DataMessage) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatalf("JSON encoding failed: %s", err)
+	}
+	fromJSON = &DataMessage{}
+	if err = json.Unmarshal(data, fromJSON); err != nil {
+		t.Fatalf("JSON decoding failed: %s", err)
+	}
+
+	if data, err = msg.MarshalBinary(); err != nil {
+		t.Fatalf("binary encoding failed: %s", err)
+	}
+	fromBinary = &DataMessage{}
+	if err = fromBinary.UnmarshalBinary(data); err != nil {
+		t.Fatalf("binary decoding failed: %s", err)
+	}
+
+	return fromJSON, fromBinary
+}
+
+func TestEncodeValueTypes(t *testing.T) {
+	for _, test := range codecValues {
+		if _, dtype := EncodeValue(test.value); dtype != test.dtype {
+			t.Errorf("%s: data type %s, want %s", test.name, dtype, test.dtype)
+		}
+	}
+}
+
+func TestCodecValues(t *testing.T) {
+	for _, test := range codecValues {
+		t.Run(test.name, func(t *testing.T) {
+			p := DataPoint{ID: 1, Time: codecTime, Quality: 0xC0}
+			p.Value, p.Type = EncodeValue(test.value)
+			fromJSON, fromBinary := codecRoundTrip(t, &DataMessage{Version: 2, Group: "g", Count: 1, Points: []DataPoint{p}})
+
+			for path, msg := range map[string]*DataMessage{"JSON": fromJSON, "binary": fromBinary} {
+				got := msg.Points[0]
+				if got.Type != test.dtype {
+					t.Errorf("%s: data type %s, want %s", path, got.Type, test.dtype)
+				}
+
+				value, err := DecodeValue(got.Value, got.Type)
+				if err != nil {
+					t.Fatalf("%s: decoding value failed: %s", path, err)
+				}
+				if !reflect.DeepEqual(normalize(value), normalize(test.want)) {
+					t.Errorf("%s: value %#v, want %#v", path, value, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestCodecMessage(t *testing.T) {
+	msg := codecMessage()
+	fromJSON, fromBinary := codecRoundTrip(t, msg)
+
+	if fromBinary.Version != 2 || fromBinary.Group != msg.Group || fromBinary.Sequence != msg.Sequence ||
+		fromBinary.IntervalMs != msg.IntervalMs || fromBinary.Interval != msg.Interval || fromBinary.Count != msg.Count {
+		t.Fatalf("binary header %+v, want %+v", *fromBinary, *msg)
+	}
+	if len(fromBinary.Points) != len(msg.Points) || len(fromJSON.Points) != len(msg.Points) {
+		t.Fatalf("decoded %d binary and %d JSON points, want %d", len(fromBinary.Points), len(fromJSON.Points), len(msg.Points))
+	}
+
+	for i, want := range msg.Points {
+		jp, bp := fromJSON.Points[i], fromBinary.Points[i]
+		if bp.ID != want.ID || bp.Quality != want.Quality || bp.Flags != want.Flags || bp.QualityText != want.QualityText || bp.Type != jp.Type {
+			t.Errorf("point %d: binary %+v, JSON %+v", i, bp, jp)
+		}
+
+		// Names are only sent in binary messages for points without an ID
+		if want.ID == 0 && bp.Name != want.Name {
+			t.Errorf("point %d: name '%s', want '%s'", i, bp.Name, want.Name)
+		}
+		if want.ID != 0 && bp.Name != "" {
+			t.Errorf("point %d: name '%s' sent with ID", i, bp.Name)
+		}
+
+		if !bp.Time.Equal(jp.Time) || !bp.Time.Equal(want.Time) || bp.Time.IsZero() != want.Time.IsZero() {
+			t.Errorf("point %d: time %s, JSON %s, want %s", i, bp.Time, jp.Time, want.Time)
+		}
+		if (bp.Received == nil) != (want.Received == nil) || (bp.Received != nil && (!bp.Received.Equal(*want.Received) || !bp.Received.Equal(*jp.Received))) {
+			t.Errorf("point %d: receive time %v, want %v", i, bp.Received, want.Received)
+		}
+
+		jv, jerr := DecodeValue(jp.Value, jp.Type)
+		bv, berr := DecodeValue(bp.Value, bp.Type)
+		if jerr != nil || berr != nil {
+			t.Fatalf("point %d: decoding failed, JSON: %v, binary: %v", i, jerr, berr)
+		}
+		if !reflect.DeepEqual(normalize(bv), normalize(jv)) {
+			t.Errorf("point %d: binary value %#v, JSON value %#v", i, bv, jv)
+		}
+	}
+}
+
+func TestCodecJSONDecodedMessage(t *testing.T) {
+	// Messages decoded from JSON, e.g. by a relay, encode to the same binary message
+	msg := codecMessage()
+	fromJSON, _ := codecRoundTrip(t, msg)
+
+	want, err := msg.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := fromJSON.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("binary message of JSON decoded message differs")
+	}
+}
+
+func TestCodecUntyped(t *testing.T) {
+	value := map[string]interface{}{"a": 1.5, "b": []interface{}{"c"}}
+	msg := &DataMessage{Version: 2, Count: 1, Points: []DataPoint{{Name: "untyped", Value: value}}}
+	_, fromBinary := codecRoundTrip(t, msg)
+
+	if got := fromBinary.Points[0]; got.Type != "" || !reflect.DeepEqual(got.Value, value) {
+		t.Errorf("untyped value %#v of type '%s', want %#v", got.Value, got.Type, value)
+	}
+}
+
+func TestCodecZeroTimes(t *testing.T) {
+	msg := &DataMessage{Version: 2, Count: 2, Points: []DataPoint{{ID: 1, Value: true, Type: ValueBool}, {ID: 2, Value: false, Type: ValueBool}}}
+	_, fromBinary := codecRoundTrip(t, msg)
+
+	for i, p := range fromBinary.Points {
+		if !p.Time.IsZero() || p.Received != nil {
+			t.Errorf("point %d: time %s, receive time %v, want zero", i, p.Time, p.Received)
+		}
+	}
+}
+
+func TestCodecSizes(t *testing.T) {
+	msg := codecMessage()
+	data, err := msg.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := msg.Points[0].Time
+	size := msg.BinaryHeaderSize(len(msg.Points), base)
+	previous := base
+	for _, p := range msg.Points {
+		size += BinaryPointSize(p, previous)
+		if !p.Time.IsZero() {
+			previous = p.Time
+		}
+	}
+
+	if size != len(data) {
+		t.Errorf("sizes add up to %d bytes, message is %d bytes", size, len(data))
+	}
+}
+
+func TestCodecTruncated(t *testing.T) {
+	data, err := codecMessage().MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for n := 0; n < len(data); n++ {
+		var msg DataMessage
+		if err := msg.UnmarshalBinary(data[:n]); err == nil {
+			t.Errorf("message truncated to %d of %d bytes decoded without error", n, len(data))
+		}
+	}
+}
+
+func TestCodecCorrupt(t *testing.T) {
+	valid, err := codecMessage().MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Header of a message of group "g" with one point, followed by the point
+	header := []byte{BinaryMagic, BinaryVersion, 0, 0, 1, 'g', 1, 0, 0}
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"JSON", []byte(`{"version":2}`)},
+		{"magic", append([]byte{0xDE}, valid[1:]...)},
+		{"version", append([]byte{BinaryMagic, BinaryVersion + 1}, valid[2:]...)},
+		{"count", []byte{BinaryMagic, BinaryVersion, 0, 0, 0, 0xFF, 0xFF, 0x03, 0, 0}},
+		{"group length", []byte{BinaryMagic, BinaryVersion, 0, 0, 0xFF, 0x01, 'g'}},
+		{"data type", append(header, 0, 1, 0, 0, 0, 0x70)},
+		{"array length", append(header, 0, 1, 0, 0, 0, 0x80|2, 0xFF, 0xFF, 0x03, 1)},
+		{"null array length", append(header, 0, 1, 0, 0, 0, 0x80, 0x81, 0x80, 0x04)},
+		{"float64 array length", append(header, 0, 1, 0, 0, 0, 0x80|11, 2, 0, 0, 0, 0, 0, 0, 0, 0)},
+		{"string length", append(header, 0, 1, 0, 0, 0, 12, 0x10, 'a')},
+		{"untyped JSON", append(header, 0, 1, 0, 0, 0, binaryUntyped, 2, '{', '"')},
+		{"varint", append(header, 0, 1, 0, 0, 0, 2, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x01)},
+	}
+
+	for _, test := range tests {
+		var msg DataMessage
+		if err := msg.UnmarshalBinary(test.data); err == nil {
+			t.Errorf("%s: corrupt message decoded without error", test.name)
+		}
+	}
+
+	// Flipped bits must not crash the decoder
+	for i := range valid {
+		for bit := 0; bit < 8; bit++ {
+			data := append([]byte(nil), valid...)
+			data[i] ^= 1 << bit
+			var msg DataMessage
+			msg.UnmarshalBinary(data)
+		}
+	}
+}
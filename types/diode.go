@@ -1,24 +1,71 @@
 package types
 
 import (
+	"dd-opcda/sign"
 	"net"
+	"time"
 
 	"gorm.io/gorm"
 )
 
+// Wire formats of data messages
+const (
+	FormatJSON   = iota // Version 2 JSON, the default
+	FormatBinary = iota // Compact binary, see DataMessage.MarshalBinary
+)
+
 type DiodeProxy struct {
 	gorm.Model
-	Name        string      `json:"name"`
-	Description string      `json:"description"`
-	EndpointIP  string      `json:"ip"`
-	EndpointMAC string      `json:"mac"`
-	MetaPort    int         `json:"metaport"`
-	DataPort    int         `json:"dataport"`
-	FilePort    int         `json:"fileport"`
-	DataChan    chan []byte `json:"-" gorm:"-"`
-	MetaChan    chan []byte `json:"-" gorm:"-"`
-	FileChan    chan []byte `json:"-" gorm:"-"`
-	DataCon     net.Conn    `json:"-" gorm:"-"`
-	MetaCon     net.Conn    `json:"-" gorm:"-"`
-	FileCon     net.Conn    `json:"-" gorm:"-"`
+	Name            string        `json:"name"`
+	Description     string        `json:"description"`
+	EndpointIP      string        `json:"ip"`
+	EndpointMAC     string        `json:"mac"`
+	MetaPort        int           `json:"metaport"`
+	DataPort        int           `json:"dataport"`
+	FilePort        int           `json:"fileport"`
+	Format          int           `json:"format"`          // FormatJSON or FormatBinary
+	MaxDatagramSize int           `json:"maxdatagramsize"` // Max bytes of UDP payload in a data packet, 0 = the proxy.maxdatagramsize setting
+	FECGroupSize    int           `json:"fecgroupsize"`    // Packets per XOR parity packet, 0 = no forward error correction
+	Health          ProxyHealth   `json:"health" gorm:"-"`
+	DataChan        chan []byte   `json:"-" gorm:"-"`
+	MetaChan        chan []byte   `json:"-" gorm:"-"`
+	FileChan        chan []byte   `json:"-" gorm:"-"`
+	DataCon         net.Conn      `json:"-" gorm:"-"`
+	MetaCon         net.Conn      `json:"-" gorm:"-"`
+	FileCon         net.Conn      `json:"-" gorm:"-"`
+	Keyring         *sign.Keyring `json:"-" gorm:"-"` // Signing keys, packets are signed if there are any
+}
+
+// SigningKey is an HMAC-SHA256 key packets sent through a proxy are signed with. The
+// key that became valid last signs, so keys are rotated by adding a key that becomes
+// valid before the old key's NotAfter. The secret is write-only: it is never sent as
+// JSON and is only set from SigningKeyData by the signing key routes
+type SigningKey struct {
+	gorm.Model
+	DiodeProxyID uint       `json:"diodeproxyid"`
+	KeyID        int        `json:"keyid"`     // 1-65535, sent with every packet
+	Secret       string     `json:"-"`         // Hex encoded, at least 16 bytes
+	NotBefore    *time.Time `json:"notbefore"` // Valid from, nil = always
+	NotAfter     *time.Time `json:"notafter"`  // Valid until, nil = always
+}
+
+// SigningKeyData is a signing key as posted to the signing key routes
+type SigningKeyData struct {
+	ID           uint       `json:"id"`
+	DiodeProxyID uint       `json:"diodeproxyid"`
+	KeyID        int        `json:"keyid"`
+	Secret       string     `json:"secret"` // Empty keeps the secret of an updated key
+	NotBefore    *time.Time `json:"notbefore"`
+	NotAfter     *time.Time `json:"notafter"`
+}
+
+// ProxyHealth tracks the outcome of the packets sent through a proxy. A diode gives no
+// feedback, so a proxy is healthy as long as its packets can be written locally
+type ProxyHealth struct {
+	Healthy   bool      `json:"healthy"`
+	Sent      uint64    `json:"sent"`
+	Failed    uint64    `json:"failed"`
+	Dropped   uint64    `json:"dropped"` // Packets dropped because the send queue was full
+	LastSent  time.Time `json:"lastsent"`
+	LastError string    `json:"lasterror"`
 }
@@ -2,25 +2,31 @@ package types
 
 import "time"
 
+// Data point flags
+const (
+	PointFlagFrozen = 1 << iota // Value unchanged for longer than the tag's frozen threshold
+	PointFlagStale              // Quality not good for longer than the tag's stale threshold
+)
+
 // Version 2 message types
 type DataPoint struct {
-	ID      int         `json:"id"`
-	Time    time.Time   `json:"t"`
-	Name    string      `json:"n"`
-	Value   interface{} `json:"v"`
-	Quality int         `json:"q"`
+	ID          int         `json:"id"`
+	Time        time.Time   `json:"t"`
+	Name        string      `json:"n"`
+	Value       interface{} `json:"v"`            // Encoded by EncodeValue
+	Type        string      `json:"dt,omitempty"` // Data type of the value, see ValueInt64 etc.
+	Quality     int         `json:"q"`
+	QualityText string      `json:"qt,omitempty"` // Decoded quality, if enabled for the group
+	Received    *time.Time  `json:"rt,omitempty"` // Local receive time, if the group sends both timestamps
+	Flags       int         `json:"f,omitempty"`  // PointFlagFrozen, PointFlagStale
 }
 
 type DataMessage struct {
-	Version  int         `json:"version"`
-	Group    string      `json:"group"`
-	Interval int         `json:"interval"`
-	Sequence uint64      `json:"sequence"`
-	Count    int         `json:"count"`
-	Points   []DataPoint `json:"points"`
-}
-
-type DataPointMeta struct {
-	ID   int    `json:"id"`
-	Name string `json:"n"`
+	Version    int         `json:"version"`
+	Group      string      `json:"group"`
+	Interval   int         `json:"interval"`   // Group sampling interval in seconds, rounded down, for receivers of earlier versions
+	IntervalMs int         `json:"intervalms"` // Group sampling interval in milliseconds
+	Sequence   uint64      `json:"sequence"`
+	Count      int         `json:"count"`
+	Points     []DataPoint `json:"points"`
 }
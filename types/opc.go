@@ -12,33 +12,116 @@ const (
 	GroupStatusRunningWithWarning = iota
 )
 
+// Group lifecycle states as tracked by the engine's group supervisor
+const (
+	GroupStateStarting = "starting"
+	GroupStateRunning  = "running"
+	GroupStateDegraded = "degraded"
+	GroupStateStopping = "stopping"
+	GroupStateStopped  = "stopped"
+)
+
+const (
+	GroupModePolling      = iota
+	GroupModeSubscription = iota
+)
+
+const (
+	DeadbandNone     = iota
+	DeadbandAbsolute = iota
+	DeadbandPercent  = iota
+)
+
+const (
+	TimestampServer = iota
+	TimestampLocal  = iota
+	TimestampBoth   = iota
+)
+
+const (
+	ScaleNone   = iota
+	ScaleLinear = iota
+	ScaleRange  = iota
+)
+
 type OPCGroup struct {
 	gorm.Model
-	Name         string     `json:"name"`
-	Description  string     `json:"description"`
-	Interval     int        `json:"interval"` // Sampling interval in seconds
-	Status       int        `json:"status"`   // 0 = stopped, 1 = running, 2 = running with warning
-	LastRun      time.Time  `json:"lastrun"`
-	Counter      uint       `json:"counter"`
-	RunAtStart   bool       `json:"runatstart"`
-	LastError    string     `json:"lasterror"`
-	ProgID       string     `json:"progid"`
-	DiodeProxyID uint       `json:"diodeproxyid"`
-	DiodeProxy   DiodeProxy `json:"diodeproxy"`
-	DefaultGroup bool       `json:"defaultgroup"`
+	Name             string       `json:"name"`
+	Description      string       `json:"description"`
+	Interval         int          `json:"interval"`       // Sampling interval in milliseconds
+	Status           int          `json:"status"`         // 0 = stopped, 1 = running, 2 = running with warning
+	State            string       `json:"state" gorm:"-"` // Lifecycle state of the group's collector
+	LastRun          time.Time    `json:"lastrun"`
+	Counter          uint         `json:"counter"`
+	RunAtStart       bool         `json:"runatstart"`
+	LastError        string       `json:"lasterror"`
+	ProgID           string       `json:"progid"`
+	SourceType       string       `json:"sourcetype"` // Data source backend, empty = same as the server with ProgID
+	DiodeProxyID     uint         `json:"diodeproxyid"`
+	DiodeProxy       DiodeProxy   `json:"diodeproxy"`
+	RedundantProxies []DiodeProxy `json:"redundantproxies" gorm:"many2many:opc_group_redundant_proxies"` // Additional paths all data is also sent through
+	DefaultGroup     bool         `json:"defaultgroup"`
+	MaxSilence       int          `json:"maxsilence"`                        // Max seconds a deadband may hold back a tag value, 0 = use setting
+	Mode             int          `json:"mode"`                              // 0 = polling, 1 = subscription
+	UpdateRate       int          `json:"updaterate"`                        // Subscription update rate in milliseconds, 0 = same as interval
+	PercentDeadband  float64      `json:"percentdeadband"`                   // Subscription deadband in percent of the engineering range
+	MissedCycles     uint         `json:"missedcycles"`                      // Cycles skipped because the previous cycle overran
+	Reconnects       uint         `json:"reconnects"`                        // Times the data source was reconnected since the group started
+	QualityPolicy    int          `json:"qualitypolicy"`                     // 0 = send all, 1 = drop bad, 2 = bad with last good value, 3 = bad on quality transitions
+	QualityText      bool         `json:"qualitytext"`                       // Add the decoded quality as text to each data point
+	TimestampSource  int          `json:"timestampsource"`                   // 0 = server, 1 = local receive time, 2 = server and receive time
+	MaxClockSkew     int          `json:"maxclockskew"`                      // Max seconds server time may drift from local time, 0 = use setting
+	ClockSkew        float64      `json:"clockskew"`                         // Last measured seconds local time is ahead of server time
+	AlignToClock     bool         `json:"aligntoclock"`                      // Sample on wall-clock multiples of the interval
+	JitterMean       float64      `json:"jittermean"`                        // Average milliseconds cycles started late since the group started
+	JitterMax        float64      `json:"jittermax"`                         // Max milliseconds a cycle started late since the group started
+	FrozenAfter      int          `json:"frozenafter"`                       // Seconds a tag value may be unchanged before it is frozen, 0 = not checked
+	StaleAfter       int          `json:"staleafter"`                        // Seconds a tag quality may be non-good before it is stale, 0 = not checked
+	Schedule         string       `json:"schedule"`                          // Weekly windows the group runs in, e.g. 'mon-fri 06:00-18:00', empty = not scheduled
+	ScheduleActive   bool         `json:"scheduleactive" gorm:"-"`           // A window of the schedule is open
+	ScheduleChange   *time.Time   `json:"schedulechange,omitempty" gorm:"-"` // Next time a window opens or closes
 }
 
 type OPCTag struct {
 	gorm.Model
 	Name                string   `json:"name"`
 	Description         string   `json:"description"`
-	Integrator          float64  `json:"integrator"`
-	IntegratingDeadband float64  `json:"integratingdeadband"`
+	Integrator          float64  `json:"integrator"`          // Integral of the deviation from the last sent value
+	IntegratingDeadband float64  `json:"integratingdeadband"` // Report when Integrator exceeds this (value * seconds), 0 = report all
+	DeadbandType        int      `json:"deadbandtype"`        // 0 = none, 1 = absolute, 2 = percent of engineering range
+	Deadband            float64  `json:"deadband"`            // Report when the value moved more than this from the last sent value
+	EULow               float64  `json:"eulow"`               // Engineering range low limit
+	EUHigh              float64  `json:"euhigh"`              // Engineering range high limit
+	ScaleMode           int      `json:"scalemode"`           // 0 = none, 1 = value * scale + offset, 2 = raw range to engineering range
+	Scale               float64  `json:"scale"`               // Linear scaling factor
+	Offset              float64  `json:"offset"`              // Linear scaling offset
+	RawLow              float64  `json:"rawlow"`              // Raw range low limit, mapped to EULow
+	RawHigh             float64  `json:"rawhigh"`             // Raw range high limit, mapped to EUHigh
+	Clamp               bool     `json:"clamp"`               // Limit scaled values to the engineering range
+	Unit                string   `json:"unit"`                // Engineering unit, sent with the tag meta data
+	Expression          string   `json:"expression"`          // Calculated tag: value computed from other tags in the group
+	RateMultiple        int      `json:"ratemultiple"`        // Read every Nth cycle of the group, 0 or 1 = every cycle
+	FrozenAfter         int      `json:"frozenafter"`         // Seconds the value may be unchanged before it is frozen, 0 = same as group
+	StaleAfter          int      `json:"staleafter"`          // Seconds the quality may be non-good before it is stale, 0 = same as group
+	DataType            int      `json:"datatype"`            // Item property: canonical data type (VARIANT type)
+	AccessRights        int      `json:"accessrights"`        // Item property: 1 = readable, 2 = writable, 3 = both
+	ItemDescription     string   `json:"itemdescription"`     // Item property: description
+	ItemUnit            string   `json:"itemunit"`            // Item property: engineering unit
+	ItemEULow           *float64 `json:"itemeulow"`           // Item property: engineering range low limit, nil if not provided
+	ItemEUHigh          *float64 `json:"itemeuhigh"`          // Item property: engineering range high limit, nil if not provided
 	GroupID             uint     `json:"groupid"`
 	Group               OPCGroup `json:"group"`
 }
 
 type TagsInfos struct {
-	ID   uint   `json:"id"`
-	Name string `json:"name"`
+	ID              uint     `json:"id"`
+	Name            string   `json:"name"`
+	Unit            string   `json:"unit,omitempty"`
+	RateMultiple    int      `json:"ratemultiple,omitempty"`
+	DataType        int      `json:"datatype,omitempty"`
+	AccessRights    int      `json:"accessrights,omitempty"`
+	ItemDescription string   `json:"itemdescription,omitempty"`
+	ItemUnit        string   `json:"itemunit,omitempty"`
+	ItemEULow       *float64 `json:"itemeulow,omitempty"`
+	ItemEUHigh      *float64 `json:"itemeuhigh,omitempty"`
 }
@@ -0,0 +1,94 @@
+package types
+
+import "strings"
+
+// OPC DA quality is a byte of status (bits 7-6), substatus (bits 5-2) and limit (bits 1-0)
+const (
+	QualityStatusMask    = 0xC0
+	QualitySubstatusMask = 0xFC
+	QualityLimitMask     = 0x03
+
+	QualityBad       = 0x00
+	QualityUncertain = 0x40
+	QualityGood      = 0xC0
+
+	QualityNotConnected = 0x08 // Bad, not connected
+	QualityCommFailure  = 0x18 // Bad, communication failure
+)
+
+const (
+	QualityPolicyAll         = iota // Send values of any quality
+	QualityPolicyDropBad     = iota // Do not send values of bad quality
+	QualityPolicyLastGood    = iota // Send bad values with the last good value
+	QualityPolicyTransitions = iota // Send bad values only when the quality changes
+)
+
+var qualityStatus = map[int]string{
+	QualityBad:       "bad",
+	QualityUncertain: "uncertain",
+	QualityGood:      "good",
+}
+
+// qualitySubstatus is keyed by status and substatus bits, as substatus depends on status
+var qualitySubstatus = map[int]string{
+	0x00: "non-specific",
+	0x04: "configuration error",
+	0x08: "not connected",
+	0x0C: "device failure",
+	0x10: "sensor failure",
+	0x14: "last known value",
+	0x18: "communication failure",
+	0x1C: "out of service",
+	0x20: "waiting for initial data",
+	0x40: "non-specific",
+	0x44: "last usable value",
+	0x50: "sensor not accurate",
+	0x54: "engineering units exceeded",
+	0x58: "sub-normal",
+	0xC0: "non-specific",
+	0xD8: "local override",
+}
+
+var qualityLimit = []string{"not limited", "low limited", "high limited", "constant"}
+
+// Quality is a decoded OPC DA quality
+type Quality struct {
+	Status    string `json:"status"`
+	Substatus string `json:"substatus"`
+	Limit     string `json:"limit"`
+}
+
+// DecodeQuality decodes the status, substatus and limit bits of an OPC DA quality.
+// Status bits 10, which OPC DA does not define, decode as bad
+func DecodeQuality(quality int) Quality {
+	status := quality & QualityStatusMask
+	if _, ok := qualityStatus[status]; !ok {
+		status = QualityBad
+	}
+
+	substatus, ok := qualitySubstatus[quality&QualitySubstatusMask]
+	if !ok || quality&QualityStatusMask != status {
+		substatus = "unknown"
+	}
+
+	return Quality{Status: qualityStatus[status], Substatus: substatus, Limit: qualityLimit[quality&QualityLimitMask]}
+}
+
+// QualityBadStatus returns true if the status of an OPC DA quality is bad
+func QualityBadStatus(quality int) bool {
+	return DecodeQuality(quality).Status == "bad"
+}
+
+// String returns the quality as text, e.g. 'uncertain, last usable value, low limited'.
+// Non-specific substatus and no limit are left out
+func (q Quality) String() string {
+	parts := []string{q.Status}
+	if q.Substatus != "non-specific" {
+		parts = append(parts, q.Substatus)
+	}
+	if q.Limit != qualityLimit[0] {
+		parts = append(parts, q.Limit)
+	}
+
+	return strings.Join(parts, ", ")
+}
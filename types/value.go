@@ -0,0 +1,251 @@
+package types
+
+import (
+	"fmt"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Data types of data point values, sent in DataPoint.Type. Values that JSON numbers can
+// not hold exactly (64-bit integers, decimals) and times are sent as strings. Arrays are
+// the element type followed by '[]', and arrays of mixed types are 'variant[]' arrays of
+// objects with the data type and value of each element
+const (
+	ValueNull    = "null"
+	ValueBool    = "bool"
+	ValueInt8    = "int8"
+	ValueInt16   = "int16"
+	ValueInt32   = "int32"
+	ValueInt64   = "int64"
+	ValueUint8   = "uint8"
+	ValueUint16  = "uint16"
+	ValueUint32  = "uint32"
+	ValueUint64  = "uint64"
+	ValueFloat32 = "float32"
+	ValueFloat64 = "float64"
+	ValueString  = "string"
+	ValueTime    = "time"    // RFC 3339 with nanoseconds
+	ValueDecimal = "decimal" // Exact decimal number, e.g. currency
+	ValueVariant = "variant"
+	ValueArray   = "[]"
+)
+
+// Decimal is an exact decimal number, Unscaled / 10^Scale
+type Decimal struct {
+	Unscaled *big.Int
+	Scale    int
+}
+
+// VariantElement is an element of an array of mixed types
+type VariantElement struct {
+	Type  string      `json:"dt"`
+	Value interface{} `json:"v"`
+}
+
+func (d Decimal) String() string {
+	if d.Unscaled == nil {
+		return "0"
+	}
+
+	digits := new(big.Int).Abs(d.Unscaled).String()
+	sign := ""
+	if d.Unscaled.Sign() < 0 {
+		sign = "-"
+	}
+
+	if d.Scale <= 0 {
+		return sign + digits + strings.Repeat("0", -d.Scale)
+	}
+
+	if len(digits) <= d.Scale {
+		digits = strings.Repeat("0", d.Scale-len(digits)+1) + digits
+	}
+
+	return sign + digits[:len(digits)-d.Scale] + "." + digits[len(digits)-d.Scale:]
+}
+
+// Float64 returns the nearest float64, for comparisons and arithmetic
+func (d Decimal) Float64() float64 {
+	f, _ := strconv.ParseFloat(d.String(), 64)
+	return f
+}
+
+// ParseDecimal parses a decimal number such as '-12.3400'
+func ParseDecimal(text string) (Decimal, error) {
+	digits := strings.Replace(text, ".", "", 1)
+	unscaled, ok := new(big.Int).SetString(digits, 10)
+	if !ok {
+		return Decimal{}, fmt.Errorf("invalid decimal: %s", text)
+	}
+
+	scale := 0
+	if i := strings.Index(text, "."); i >= 0 {
+		scale = len(text) - i - 1
+	}
+
+	return Decimal{Unscaled: unscaled, Scale: scale}, nil
+}
+
+// EncodeValue returns the JSON representation and data type of a data point value
+func EncodeValue(v interface{}) (interface{}, string) {
+	switch value := v.(type) {
+	case nil:
+		return nil, ValueNull
+	case bool:
+		return value, ValueBool
+	case int8:
+		return value, ValueInt8
+	case int16:
+		return value, ValueInt16
+	case int32:
+		return value, ValueInt32
+	case int64:
+		return strconv.FormatInt(value, 10), ValueInt64
+	case int:
+		return strconv.FormatInt(int64(value), 10), ValueInt64
+	case uint8:
+		return value, ValueUint8
+	case uint16:
+		return value, ValueUint16
+	case uint32:
+		return value, ValueUint32
+	case uint64:
+		return strconv.FormatUint(value, 10), ValueUint64
+	case uint:
+		return strconv.FormatUint(uint64(value), 10), ValueUint64
+	case float32:
+		return value, ValueFloat32
+	case float64:
+		return value, ValueFloat64
+	case string:
+		return value, ValueString
+	case time.Time:
+		return value.UTC().Format(time.RFC3339Nano), ValueTime
+	case Decimal:
+		return value.String(), ValueDecimal
+	case *big.Int:
+		return value.String(), ValueDecimal
+	}
+
+	// Arrays of any element type
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return fmt.Sprintf("%v", v), ValueString
+	}
+
+	elements := make([]interface{}, rv.Len())
+	dtypes := make([]string, rv.Len())
+	mixed := false
+	for i := range elements {
+		elements[i], dtypes[i] = EncodeValue(rv.Index(i).Interface())
+		mixed = mixed || dtypes[i] != dtypes[0]
+	}
+
+	if len(elements) == 0 {
+		return elements, ValueVariant + ValueArray
+	}
+
+	if mixed {
+		for i := range elements {
+			elements[i] = VariantElement{Type: dtypes[i], Value: elements[i]}
+		}
+		return elements, ValueVariant + ValueArray
+	}
+
+	return elements, dtypes[0] + ValueArray
+}
+
+// DecodeValue converts a value decoded from JSON, or from a binary message, back to the
+// Go value of its data type
+func DecodeValue(v interface{}, dtype string) (interface{}, error) {
+	if strings.HasSuffix(dtype, ValueArray) {
+		items, ok := v.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s value is not an array", dtype)
+		}
+
+		element := strings.TrimSuffix(dtype, ValueArray)
+		values := make([]interface{}, len(items))
+		for i, item := range items {
+			itemtype := element
+			if element == ValueVariant {
+				switch variant := item.(type) {
+				case map[string]interface{}:
+					itemtype, _ = variant["dt"].(string)
+					item = variant["v"]
+				case VariantElement:
+					itemtype, item = variant.Type, variant.Value
+				default:
+					return nil, fmt.Errorf("variant array element is not an object")
+				}
+			}
+
+			var err error
+			if values[i], err = DecodeValue(item, itemtype); err != nil {
+				return nil, err
+			}
+		}
+
+		return values, nil
+	}
+
+	text, _ := v.(string)
+	number := decodedNumber(v)
+	switch dtype {
+	case ValueNull:
+		return nil, nil
+	case ValueInt8:
+		return int8(number), nil
+	case ValueInt16:
+		return int16(number), nil
+	case ValueInt32:
+		return int32(number), nil
+	case ValueUint8:
+		return uint8(number), nil
+	case ValueUint16:
+		return uint16(number), nil
+	case ValueUint32:
+		return uint32(number), nil
+	case ValueFloat32:
+		return float32(number), nil
+	case ValueInt64:
+		return strconv.ParseInt(text, 10, 64)
+	case ValueUint64:
+		return strconv.ParseUint(text, 10, 64)
+	case ValueTime:
+		return time.Parse(time.RFC3339Nano, text)
+	case ValueDecimal:
+		return ParseDecimal(text)
+	}
+
+	// bool, float64, string and untyped values are as decoded from JSON
+	return v, nil
+}
+
+// decodedNumber returns a number as decoded from JSON, a float64, or as decoded from a
+// binary message, of the type of its data type
+func decodedNumber(v interface{}) float64 {
+	switch n := v.(type) {
+	case float64:
+		return n
+	case float32:
+		return float64(n)
+	case int8:
+		return float64(n)
+	case int16:
+		return float64(n)
+	case int32:
+		return float64(n)
+	case uint8:
+		return float64(n)
+	case uint16:
+		return float64(n)
+	case uint32:
+		return float64(n)
+	}
+
+	return 0
+}
@@ -83,6 +83,7 @@ func RunWeb(args types.Context) {
 	routes.RegisterOPCRoutes(api)
 	routes.RegisterSystemRoutes(api)
 	routes.RegisterFileTransferRoutes(api)
+	routes.RegisterDiodeRoutes(api)
 
 	app.Listen(":3000")
 